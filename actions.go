@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Actions go to the local engine; with several instances the requests that carry
+// them are proxied to the owning instance before they get here
+// ctx carries the logger of the request or connection the action came from
+
+// Validates the name and asks the engine to add the player
+// returns the normalized name the player joined with
+func (h *GameHandler) join(ctx context.Context, playerID, rawName string) (string, error) {
+	logger := h.actionLogger(ctx, "join", playerID)
+	if h.Draining() {
+		return "", errRestarting
+	}
+
+	name, err := h.Names.Normalize(rawName)
+	if err != nil {
+		logger.Info("name rejected", "err", err)
+		return "", err
+	}
+
+	player, err := h.Engine.Join(playerID, name)
+	if err != nil {
+		logger.Info("join refused", "err", err)
+		return "", err
+	}
+	logger.Info("player joined", "name", player.Name)
+	return player.Name, nil
+}
+
+// Asks the engine to remove the player
+// returns the name of the player who left
+func (h *GameHandler) leave(ctx context.Context, playerID string) (string, error) {
+	logger := h.actionLogger(ctx, "leave", playerID)
+
+	player, err := h.Engine.Leave(playerID)
+	if err != nil {
+		logger.Info("leave refused", "err", err)
+		return "", err
+	}
+	logger.Info("player left", "name", player.Name)
+	return player.Name, nil
+}
+
+// Rolls the dice for the player
+func (h *GameHandler) roll(ctx context.Context, playerID string) (RollResult, error) {
+	logger := h.actionLogger(ctx, "roll", playerID)
+
+	result, err := h.Engine.Roll(playerID)
+	if err != nil {
+		logger.Info("roll refused", "err", err)
+		return result, err
+	}
+	logger.Debug("dice rolled", "roll", result.Roll, "cell", result.CellValue, "teleported", result.Teleported, "completed", result.Completed)
+	return result, nil
+}
+
+// Posts a chat message from the player into the stream
+func (h *GameHandler) chat(ctx context.Context, playerID, text string) error {
+	logger := h.actionLogger(ctx, "chat", playerID)
+
+	if err := h.Engine.Chat(playerID, text); err != nil {
+		logger.Info("chat refused", "err", err)
+		return err
+	}
+	logger.Debug("chat posted", "length", len(text))
+	return nil
+}
+
+// Turns the events of one engine command into stream logs and dirty fragments
+// Runs on the engine goroutine, so it sees commands in the order they were applied
+func (h *GameHandler) present(events []DomainEvent) {
+	dirty := []string{}
+	var at time.Time
+	push := func(logType, msg string) {
+		h.Stream.Push(StreamLog{
+			TimeStamp: at,
+			Message:   msg,
+			LogType:   logType,
+		})
+	}
+
+	// A roll carries DiceRolled, Moved and optionally Teleported and Completed
+	var rolled DiceRolled
+	teleported := false
+	for _, ev := range events {
+		if _, ok := ev.(Teleported); ok {
+			teleported = true
+		}
+	}
+
+	for _, ev := range events {
+		at = ev.At()
+		switch ev := ev.(type) {
+		case PlayerJoined:
+			push(JOIN, fmt.Sprintf("%v has joined the game", ev.Name))
+			dirty = append(dirty, "players", "board", "dice", "tokens", "stream")
+		case PlayerLeft:
+			push(LEAVE, fmt.Sprintf("%v has left the game", ev.Name))
+			dirty = append(dirty, "players", "board", "dice", "tokens", "stream")
+		case DiceRolled:
+			rolled = ev
+			// A roll only changes the roller's dice, sent to them alone below
+			dirty = append(dirty, "players", "board", "tokens", "stream")
+		case Moved:
+			if !teleported {
+				push(MOVE, fmt.Sprintf("%v got %v and has moved to %v\n", ev.Name, rolled.Roll, ev.To))
+			}
+		case Teleported:
+			push(TELEPORTED, fmt.Sprintf("%v got %v and has teleported to %v\n", ev.Name, rolled.Roll, ev.To))
+		case Completed:
+			push(COMPLETED, fmt.Sprintf("%v has completed the game, took %v\n", ev.Name, ev.Elapsed))
+			logger := gameLogger(slog.Default(), h.Game.ID, "finish", ev.PlayerID)
+			logger.Info("player finished", "name", ev.Name, "elapsed", ev.Elapsed, "rolls", ev.Rolls)
+			logger.Debug("best finishes", "top", h.Leaderboard.Top())
+			dirty = append(dirty, "leaderboard")
+		case ChatPosted:
+			push(CHAT, fmt.Sprintf("%v: %v", ev.Name, ev.Text))
+			dirty = append(dirty, "stream")
+		case GameStarted:
+			push(SYSTEM, "A new round has started")
+			dirty = append(dirty, Topics...)
+		case BoardReset:
+			push(SYSTEM, "The board has been regenerated")
+			h.BoardDiff.Reset()
+			dirty = append(dirty, Topics...)
+		case AdminActed:
+			push(ADMIN, ev.Message)
+			dirty = append(dirty, "stream")
+			if strings.HasPrefix(ev.Action, "leaderboard") {
+				dirty = append(dirty, "leaderboard")
+			}
+		}
+	}
+
+	// Followers show what the owner broadcasts through the hub
+	if h.Cluster.Writable() != nil {
+		return
+	}
+	if len(dirty) > 0 {
+		h.Pipeline.MarkDirty(dirty...)
+	}
+	// Every tab of the roller shows the new roll, however it was made
+	if rolled.PlayerID != "" && slices.Contains(h.Broker.PlayerIDs("dice"), rolled.PlayerID) {
+		h.Broker.SendTo(rolled.PlayerID, "dice", h.renderTopic(h.Game.Snapshot(), "dice", rolled.PlayerID))
+	}
+}
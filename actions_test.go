@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A roll from any transport reaches the dice panel of every tab the roller has open
+func TestRollSendsDiceToEveryTab(t *testing.T) {
+	// Without a debounce the join broadcasts are out before the tabs subscribe
+	_, h := newTestHandler(t, map[string]string{"BROADCAST_DEBOUNCE_MS": "0"})
+	for _, id := range []string{"p1", "p2"} {
+		if _, err := h.join(t.Context(), id, "Player "+id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tabs := []chan Message{make(chan Message, 64), make(chan Message, 64)}
+	for _, ch := range tabs {
+		h.Broker.Add(ch, "p1", []string{"dice"})
+	}
+	other := make(chan Message, 64)
+	h.Broker.Add(other, "p2", []string{"dice"})
+
+	if _, err := h.roll(t.Context(), "p1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, ch := range tabs {
+		msg, ok := nextEvent(ch, "dice")
+		if !ok {
+			t.Fatalf("tab %v got no dice after the roll", i)
+		}
+		if msg.To != "p1" || msg.Data == "" {
+			t.Fatalf("tab %v got dice for %q: %q", i, msg.To, msg.Data)
+		}
+	}
+	if msg, ok := nextEvent(other, "dice"); ok {
+		t.Fatalf("other player got dice on someone else's roll: %+v", msg)
+	}
+}
+
+// Waits briefly for the next message of the event, looking inside batches
+func nextEvent(ch chan Message, event string) (Message, bool) {
+	timeout := time.After(200 * time.Millisecond)
+	for {
+		select {
+		case msg := <-ch:
+			for _, ev := range msg.Events() {
+				if ev.Event == event {
+					return ev, true
+				}
+			}
+		case <-timeout:
+			return Message{}, false
+		}
+	}
+}
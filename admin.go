@@ -0,0 +1,422 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* Admin: console and JSON API to manage the live game, every action audited in the stream */
+
+// gin.Context key of the authenticated admin
+const adminKey = "admin"
+
+type adminRenameRequest struct {
+	PlayerName string `json:"player_name"`
+}
+
+type adminAnnounceRequest struct {
+	Text string `json:"text"`
+}
+
+// Leaderboard entry with the key the admin routes take
+type AdminFinish struct {
+	BestFinish
+	Key string `json:"key"`
+}
+
+// Everything the console shows
+type AdminState struct {
+	Players     []Player      `json:"players"`
+	Connections []Connection  `json:"connections"`
+	Rules       Rules         `json:"rules"`
+	Leaderboard []AdminFinish `json:"leaderboard"`
+}
+
+// Compares hashes so the time taken doesn't leak the length either
+func secretEqual(given, want string) bool {
+	if want == "" {
+		return false
+	}
+	a, b := sha256.Sum256([]byte(given)), sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// Name of the admin making the request
+// ADMIN_TOKEN is accepted as a bearer token or as the basic auth password
+func (h *GameHandler) adminActor(c *gin.Context) (string, bool) {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return "admin", secretEqual(token, h.Config.AdminToken)
+	}
+
+	user, password, ok := c.Request.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	if secretEqual(user, h.Config.AdminUser) && secretEqual(password, h.Config.AdminPassword) {
+		return user, true
+	}
+	if secretEqual(password, h.Config.AdminToken) {
+		if user == "" {
+			user = "admin"
+		}
+		return user, true
+	}
+	return "", false
+}
+
+// Browsers resend basic auth on their own, so changes must come from htmx or as JSON,
+// which a form on another site can't send
+func crossSiteSafe(c *gin.Context) bool {
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+		return true
+	}
+	if strings.HasPrefix(c.GetHeader("Authorization"), "Bearer ") {
+		return true
+	}
+	return c.GetHeader("HX-Request") == "true" || c.ContentType() == "application/json"
+}
+
+// Lets admins through, browsers get a basic auth prompt
+func (h *GameHandler) AdminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		actor, ok := h.adminActor(c)
+		if ok && !crossSiteSafe(c) {
+			apiError(c, http.StatusForbidden, fmt.Errorf("Admin changes must be sent by the console or as JSON"))
+			c.Abort()
+			return
+		}
+		if !ok {
+			loggerFrom(c).Warn("admin authentication failed", "path", c.Request.URL.Path, "client_ip", c.ClientIP())
+			c.Header("WWW-Authenticate", `Basic realm="Portals admin", charset="UTF-8"`)
+			if strings.HasPrefix(c.Request.URL.Path, "/api/") {
+				apiError(c, http.StatusUnauthorized, fmt.Errorf("Admin credentials required"))
+			} else {
+				c.String(http.StatusUnauthorized, "Admin credentials required")
+			}
+			c.Abort()
+			return
+		}
+		c.Set(adminKey, actor)
+		c.Next()
+	}
+}
+
+// Runs the command, if any, on the engine and records the action in the stream and the logs
+func (h *GameHandler) adminDo(c *gin.Context, action, message string, cmd any) (any, error) {
+	actor := c.GetString(adminKey)
+	c.Set("action", "admin."+action)
+	logger := gameLogger(loggerFrom(c), h.Game.ID, "admin."+action, "").With("actor", actor)
+
+	result, err := h.Engine.Do(AdminCmd{Actor: actor, Action: action, Message: message, Cmd: cmd})
+	if err != nil {
+		logger.Info("admin action refused", "err", err)
+		return nil, err
+	}
+	if _, ok := cmd.(StoreCmd); ok {
+		message, _ = result.(string)
+	}
+	logger.Info("admin action", "message", message)
+	return result, nil
+}
+
+func (h *GameHandler) adminState() AdminState {
+	top := h.Leaderboard.Top()
+	finishes := make([]AdminFinish, len(top))
+	for i, finish := range top {
+		finishes[i] = AdminFinish{BestFinish: finish, Key: finish.Key()}
+	}
+
+	return AdminState{
+		Players:     GetCurrentPlayers(h.Game.Snapshot()),
+		Connections: h.Broker.Connections(),
+		Rules:       h.Engine.Rules(),
+		Leaderboard: finishes,
+	}
+}
+
+func (h *GameHandler) adminFinish(key string) (BestFinish, error) {
+	for _, finish := range h.Leaderboard.Top() {
+		if finish.Key() == key {
+			return finish, nil
+		}
+	}
+	return BestFinish{}, fmt.Errorf("Leaderboard entry doesn't exists")
+}
+
+// Admin actions, shared by the console and the JSON API
+
+func (h *GameHandler) adminKick(c *gin.Context, playerID string) error {
+	name, err := h.Game.PlayerName(playerID)
+	if err != nil {
+		return err
+	}
+	actor := c.GetString(adminKey)
+	_, err = h.adminDo(c, "kick", fmt.Sprintf("%v kicked %v from the game", actor, name), LeaveCmd{PlayerID: playerID})
+	return err
+}
+
+func (h *GameHandler) adminStart(c *gin.Context) error {
+	_, err := h.adminDo(c, "start", fmt.Sprintf("%v started a new round", c.GetString(adminKey)), StartCmd{})
+	return err
+}
+
+func (h *GameHandler) adminReset(c *gin.Context) error {
+	_, err := h.adminDo(c, "reset", fmt.Sprintf("%v regenerated the board", c.GetString(adminKey)), ResetCmd{})
+	return err
+}
+
+func (h *GameHandler) adminRules(c *gin.Context, rules Rules) error {
+	message := fmt.Sprintf("%v changed the rules: a %v-sided dice, and a %vx%v board with %v portals once regenerated",
+		c.GetString(adminKey), rules.DiceDim, rules.BoardDim, rules.BoardDim, rules.MaxPortals)
+	_, err := h.adminDo(c, "rules", message, RulesCmd{Rules: rules})
+	return err
+}
+
+// Leaderboard edits run on the engine with their audit record, so one never goes without the other
+func (h *GameHandler) adminLeaderboardClear(c *gin.Context) error {
+	actor := c.GetString(adminKey)
+	_, err := h.adminDo(c, "leaderboard.clear", "", StoreCmd{Apply: func() (string, error) {
+		n, err := h.Leaderboard.Clear()
+		return fmt.Sprintf("%v cleared the leaderboard, %v entries removed", actor, n), err
+	}})
+	return err
+}
+
+func (h *GameHandler) adminLeaderboardRemove(c *gin.Context, key string) error {
+	finish, err := h.adminFinish(key)
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("%v removed the %v finish of %v from the leaderboard", c.GetString(adminKey), finish.Elasped, finish.PlayerName)
+	_, err = h.adminDo(c, "leaderboard.remove", message, StoreCmd{Apply: func() (string, error) {
+		return message, h.Leaderboard.Remove(key)
+	}})
+	return err
+}
+
+func (h *GameHandler) adminLeaderboardRename(c *gin.Context, key, rawName string) error {
+	finish, err := h.adminFinish(key)
+	if err != nil {
+		return err
+	}
+	name, err := h.Names.Normalize(rawName)
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("%v renamed %v to %v on the leaderboard", c.GetString(adminKey), finish.PlayerName, name)
+	_, err = h.adminDo(c, "leaderboard.rename", message, StoreCmd{Apply: func() (string, error) {
+		return message, h.Leaderboard.Rename(key, name)
+	}})
+	return err
+}
+
+func (h *GameHandler) adminAnnounce(c *gin.Context, rawText string) error {
+	text := strings.TrimSpace(rawText)
+	if text == "" {
+		return fmt.Errorf("Message required")
+	}
+	if utf8.RuneCountInString(text) > maxChatLen {
+		return fmt.Errorf("Message must be at most %v characters", maxChatLen)
+	}
+	_, err := h.adminDo(c, "announce", text, nil)
+	return err
+}
+
+// Console
+
+func (h *GameHandler) AdminPage(c *gin.Context) {
+	c.HTML(http.StatusOK, "admin.html", gin.H{"Admin": h.adminState(), "Actor": c.GetString(adminKey)})
+}
+
+// Re-renders the panel with the outcome of the action
+// htmx only swaps 2xx responses, so errors are sent back with 200
+func (h *GameHandler) adminPanel(c *gin.Context, done string, err error) {
+	data := gin.H{"Admin": h.adminState()}
+	if err != nil {
+		data["Error"] = err.Error()
+	} else {
+		data["Done"] = done
+	}
+	c.HTML(http.StatusOK, "_admin_panel.html", data)
+}
+
+func (h *GameHandler) AdminKickForm(c *gin.Context) {
+	h.adminPanel(c, "Player kicked", h.adminKick(c, c.PostForm("player_id")))
+}
+
+func (h *GameHandler) AdminStartForm(c *gin.Context) {
+	h.adminPanel(c, "New round started", h.adminStart(c))
+}
+
+func (h *GameHandler) AdminResetForm(c *gin.Context) {
+	h.adminPanel(c, "Board regenerated", h.adminReset(c))
+}
+
+func (h *GameHandler) AdminRulesForm(c *gin.Context) {
+	var rules Rules
+	var err error
+	fields := []struct {
+		name string
+		dst  *int
+	}{
+		{"dice_dim", &rules.DiceDim},
+		{"board_dim", &rules.BoardDim},
+		{"max_portals", &rules.MaxPortals},
+	}
+	for _, f := range fields {
+		if *f.dst, err = strconv.Atoi(strings.TrimSpace(c.PostForm(f.name))); err != nil {
+			h.adminPanel(c, "", fmt.Errorf("%v must be a number", f.name))
+			return
+		}
+	}
+	h.adminPanel(c, "Rules updated", h.adminRules(c, rules))
+}
+
+func (h *GameHandler) AdminLeaderboardClearForm(c *gin.Context) {
+	h.adminPanel(c, "Leaderboard cleared", h.adminLeaderboardClear(c))
+}
+
+func (h *GameHandler) AdminLeaderboardRemoveForm(c *gin.Context) {
+	h.adminPanel(c, "Entry removed", h.adminLeaderboardRemove(c, c.PostForm("key")))
+}
+
+func (h *GameHandler) AdminLeaderboardRenameForm(c *gin.Context) {
+	h.adminPanel(c, "Entry renamed", h.adminLeaderboardRename(c, c.PostForm("key"), c.PostForm("player_name")))
+}
+
+func (h *GameHandler) AdminAnnounceForm(c *gin.Context) {
+	h.adminPanel(c, "Announcement posted", h.adminAnnounce(c, c.PostForm("text")))
+}
+
+// JSON API
+
+// Maps an admin action error to a status, unknown players and entries are 404s
+func adminAPIError(c *gin.Context, err error) {
+	status := http.StatusUnprocessableEntity
+	if strings.Contains(err.Error(), "doesn't exists") {
+		status = http.StatusNotFound
+	}
+	apiError(c, status, err)
+}
+
+// Answers with the console state once the action is done
+func (h *GameHandler) adminAPIResult(c *gin.Context, err error) {
+	if err != nil {
+		adminAPIError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, h.adminState())
+}
+
+func (h *GameHandler) APIAdminState(c *gin.Context) {
+	c.JSON(http.StatusOK, h.adminState())
+}
+
+func (h *GameHandler) APIAdminPlayers(c *gin.Context) {
+	c.JSON(http.StatusOK, h.adminState().Players)
+}
+
+func (h *GameHandler) APIAdminConnections(c *gin.Context) {
+	c.JSON(http.StatusOK, h.Broker.Connections())
+}
+
+func (h *GameHandler) APIAdminKick(c *gin.Context) {
+	h.adminAPIResult(c, h.adminKick(c, c.Param("id")))
+}
+
+func (h *GameHandler) APIAdminStart(c *gin.Context) {
+	h.adminAPIResult(c, h.adminStart(c))
+}
+
+func (h *GameHandler) APIAdminReset(c *gin.Context) {
+	h.adminAPIResult(c, h.adminReset(c))
+}
+
+func (h *GameHandler) APIAdminRules(c *gin.Context) {
+	c.JSON(http.StatusOK, h.Engine.Rules())
+}
+
+// Fields left out keep their current value
+func (h *GameHandler) APIAdminSetRules(c *gin.Context) {
+	rules := h.Engine.Rules()
+	if err := c.ShouldBindJSON(&rules); err != nil {
+		apiError(c, http.StatusBadRequest, err)
+		return
+	}
+	h.adminAPIResult(c, h.adminRules(c, rules))
+}
+
+func (h *GameHandler) APIAdminLeaderboard(c *gin.Context) {
+	c.JSON(http.StatusOK, h.adminState().Leaderboard)
+}
+
+func (h *GameHandler) APIAdminLeaderboardClear(c *gin.Context) {
+	h.adminAPIResult(c, h.adminLeaderboardClear(c))
+}
+
+func (h *GameHandler) APIAdminLeaderboardRemove(c *gin.Context) {
+	h.adminAPIResult(c, h.adminLeaderboardRemove(c, c.Param("key")))
+}
+
+func (h *GameHandler) APIAdminLeaderboardRename(c *gin.Context) {
+	var req adminRenameRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, err)
+		return
+	}
+	h.adminAPIResult(c, h.adminLeaderboardRename(c, c.Param("key"), req.PlayerName))
+}
+
+func (h *GameHandler) APIAdminAnnounce(c *gin.Context) {
+	var req adminAnnounceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := h.adminAnnounce(c, req.Text); err != nil {
+		adminAPIError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Mounts the console under /admin and the API under /api/v1/admin
+// Nothing is mounted without credentials in the config, so both answer 404
+func (h *GameHandler) RegisterAdmin(router *gin.Engine) {
+	if !h.Config.AdminEnabled() {
+		return
+	}
+
+	console := router.Group("/admin", h.AdminAuth())
+	console.GET("", h.AdminPage)
+	console.POST("/kick", h.AdminKickForm)
+	console.POST("/start", h.AdminStartForm)
+	console.POST("/reset", h.AdminResetForm)
+	console.POST("/rules", h.AdminRulesForm)
+	console.POST("/leaderboard/clear", h.AdminLeaderboardClearForm)
+	console.POST("/leaderboard/remove", h.AdminLeaderboardRemoveForm)
+	console.POST("/leaderboard/rename", h.AdminLeaderboardRenameForm)
+	console.POST("/announce", h.AdminAnnounceForm)
+
+	api := router.Group("/api/v1/admin", h.AdminAuth())
+	api.GET("", h.APIAdminState)
+	api.GET("/players", h.APIAdminPlayers)
+	api.DELETE("/players/:id", h.APIAdminKick)
+	api.GET("/connections", h.APIAdminConnections)
+	api.POST("/start", h.APIAdminStart)
+	api.POST("/reset", h.APIAdminReset)
+	api.GET("/rules", h.APIAdminRules)
+	api.PUT("/rules", h.APIAdminSetRules)
+	api.GET("/leaderboard", h.APIAdminLeaderboard)
+	api.DELETE("/leaderboard", h.APIAdminLeaderboardClear)
+	api.DELETE("/leaderboard/:key", h.APIAdminLeaderboardRemove)
+	api.PATCH("/leaderboard/:key", h.APIAdminLeaderboardRename)
+	api.POST("/announce", h.APIAdminAnnounce)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* JSON REST API (v1): same Game actions as the HTMX routes, JSON in and out */
+
+type APIError struct {
+	Error string `json:"error"`
+}
+
+type APIPortal struct {
+	From     int      `json:"from"`
+	To       int      `json:"to"`
+	FromPos  Position `json:"from_position"`
+	ToPos    Position `json:"to_position"`
+	Color    string   `json:"color"`
+	IsLadder bool     `json:"is_ladder"`
+}
+
+type APICell struct {
+	Value     int      `json:"value"`
+	Position  Position `json:"position"`
+	IsPortal  bool     `json:"is_portal"`
+	Color     string   `json:"color"`
+	PlayerIDs []string `json:"player_ids"`
+}
+
+type APIBoard struct {
+	Size        int         `json:"size"`
+	LastCellVal int         `json:"last_cell"`
+	Cells       [][]APICell `json:"cells"`
+}
+
+type APIGameState struct {
+	Board       APIBoard     `json:"board"`
+	Portals     []APIPortal  `json:"portals"`
+	Players     []Player     `json:"players"`
+	Leaderboard []BestFinish `json:"leaderboard"`
+	Stream      []StreamLog  `json:"stream"`
+}
+
+type apiJoinRequest struct {
+	Name string `json:"name"`
+}
+
+type apiJoinResponse struct {
+	PlayerID string `json:"player_id"`
+	Name     string `json:"name"`
+	// Private, only sent to the client that joined without one
+	Token string `json:"token,omitempty"`
+}
+
+type apiChatRequest struct {
+	Text string `json:"text"`
+}
+
+type apiLeaveResponse struct {
+	PlayerID string `json:"player_id"`
+	Name     string `json:"name"`
+}
+
+func apiError(c *gin.Context, status int, err error) {
+	c.JSON(status, APIError{Error: err.Error()})
+}
+
+// Bots may not keep cookies, so the token is accepted in the X-Player-Token header as well
+func (h *GameHandler) apiPlayerID(c *gin.Context) (string, bool) {
+	if token := c.GetHeader("X-Player-Token"); token != "" {
+		return playerIDFromToken(token), true
+	}
+	if id, err := h.currentPlayerIDFromCookie(c); err == nil && id != "" {
+		return id, true
+	}
+	return "", false
+}
+
+// Builds the JSON view of the game from a snapshot
+func (h *GameHandler) apiGameState() APIGameState {
+	game := h.Game.Snapshot()
+
+	cells := make([][]APICell, len(game.Board))
+	portals := []APIPortal{}
+	for r, row := range game.Board {
+		cells[r] = make([]APICell, len(row))
+		for c, cell := range row {
+			ids := make([]string, 0, len(cell.Players))
+			for _, p := range cell.Players {
+				ids = append(ids, p.ID)
+			}
+			cells[r][c] = APICell{
+				Value:     cell.Value,
+				Position:  Position{Row: r, Col: c},
+				IsPortal:  cell.IsPortal,
+				Color:     cell.Color,
+				PlayerIDs: ids,
+			}
+
+			if cell.IsPortal {
+				to := game.Board[cell.Dest.Row][cell.Dest.Col].Value
+				portals = append(portals, APIPortal{
+					From:     cell.Value,
+					To:       to,
+					FromPos:  Position{Row: r, Col: c},
+					ToPos:    cell.Dest,
+					Color:    cell.Color,
+					IsLadder: to > cell.Value,
+				})
+			}
+		}
+	}
+
+	return APIGameState{
+		Board: APIBoard{
+			Size:        game.Size,
+			LastCellVal: game.LastCellVal,
+			Cells:       cells,
+		},
+		Portals:     portals,
+		Players:     GetCurrentPlayers(game),
+		Leaderboard: h.Leaderboard.Top(),
+		Stream:      h.Stream.GetLogs(),
+	}
+}
+
+func (h *GameHandler) APIGame(c *gin.Context) {
+	c.JSON(http.StatusOK, h.apiGameState())
+}
+
+func (h *GameHandler) APIBoard(c *gin.Context) {
+	c.JSON(http.StatusOK, h.apiGameState().Board)
+}
+
+func (h *GameHandler) APIPortals(c *gin.Context) {
+	c.JSON(http.StatusOK, h.apiGameState().Portals)
+}
+
+func (h *GameHandler) APIPlayers(c *gin.Context) {
+	c.JSON(http.StatusOK, h.apiGameState().Players)
+}
+
+func (h *GameHandler) APILeaderboard(c *gin.Context) {
+	c.JSON(http.StatusOK, h.apiGameState().Leaderboard)
+}
+
+func (h *GameHandler) APIStream(c *gin.Context) {
+	c.JSON(http.StatusOK, h.Stream.GetLogs())
+}
+
+func (h *GameHandler) APIJoin(c *gin.Context) {
+	var req apiJoinRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	// Minting an identity for clients that don't have one yet
+	token := ""
+	playerID, ok := h.apiPlayerID(c)
+	if !ok {
+		token = newPlayerToken()
+		playerID = playerIDFromToken(token)
+		setPlayerCookie(c, token)
+	}
+
+	name, err := h.join(c, playerID, req.Name)
+	if err != nil {
+		apiError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, apiJoinResponse{PlayerID: playerID, Name: name, Token: token})
+}
+
+func (h *GameHandler) APILeave(c *gin.Context) {
+	playerID, ok := h.apiPlayerID(c)
+	if !ok {
+		apiError(c, http.StatusUnauthorized, fmt.Errorf("Player id required"))
+		return
+	}
+
+	name, err := h.leave(c, playerID)
+	if err != nil {
+		apiError(c, http.StatusNotFound, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, apiLeaveResponse{PlayerID: playerID, Name: name})
+}
+
+func (h *GameHandler) APIRoll(c *gin.Context) {
+	playerID, ok := h.apiPlayerID(c)
+	if !ok {
+		apiError(c, http.StatusUnauthorized, fmt.Errorf("Player id required"))
+		return
+	}
+
+	result, err := h.roll(c, playerID)
+	if err != nil {
+		apiError(c, http.StatusNotFound, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+func (h *GameHandler) APIChat(c *gin.Context) {
+	playerID, ok := h.apiPlayerID(c)
+	if !ok {
+		apiError(c, http.StatusUnauthorized, fmt.Errorf("Player id required"))
+		return
+	}
+
+	var req apiChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.chat(c, playerID, req.Text); err != nil {
+		apiError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Mounts the JSON API under /api/v1
+func (h *GameHandler) RegisterAPI(router *gin.Engine) {
+	v1 := router.Group("/api/v1")
+	v1.GET("/game", h.APIGame)
+	v1.GET("/board", h.APIBoard)
+	v1.GET("/portals", h.APIPortals)
+	v1.GET("/players", h.APIPlayers)
+	v1.GET("/players/:id/stats", h.APIPlayerStats)
+	v1.GET("/leaderboard", h.APILeaderboard)
+	v1.GET("/stream", h.APIStream)
+	v1.POST("/join", h.APIJoin)
+	v1.POST("/leave", h.APILeave)
+	v1.POST("/roll", h.APIRoll)
+	v1.POST("/chat", h.APIChat)
+
+	// JSON 404s for unknown API paths
+	router.NoRoute(func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, "/api/") {
+			apiError(c, http.StatusNotFound, fmt.Errorf("Unknown endpoint"))
+			return
+		}
+		c.Status(http.StatusNotFound)
+	})
+}
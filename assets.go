@@ -0,0 +1,109 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/gin-gonic/gin/render"
+)
+
+/* Assets: templates and static files built into the binary, or read from disk with -dev */
+
+//go:generate sh scripts/vendor-assets.sh
+
+// The all: prefix keeps the _partial.html templates, which embed skips by default
+//
+//go:embed all:templates static
+var embeddedAssets embed.FS
+
+// Third-party files committed under static/vendor, refreshed by scripts/vendor-assets.sh on a version bump
+var vendoredAssets = []string{
+	"static/vendor/htmx@1.9.12/htmx.min.js",
+	"static/vendor/htmx@1.9.12/ext/sse.js",
+	"static/vendor/bootstrap@5.3.8/css/bootstrap.min.css",
+	"static/vendor/bootstrap@5.3.8/js/bootstrap.bundle.min.js",
+}
+
+// Root holding templates/ and static/: the binary, or the working directory in dev mode
+func assetsFS(dev bool) fs.FS {
+	if dev {
+		return os.DirFS(".")
+	}
+	return embeddedAssets
+}
+
+// Warns about vendored files missing from the assets, pages would load without them
+func checkVendored(assets fs.FS) {
+	for _, path := range vendoredAssets {
+		if _, err := fs.Stat(assets, path); err != nil {
+			slog.Warn("vendored asset missing, run go generate", "path", path, "err", err)
+		}
+	}
+}
+
+// Static files for /static, directories aren't listed, like with router.Static
+type staticFiles struct {
+	fs.FS
+}
+
+func (s staticFiles) Open(name string) (fs.File, error) {
+	file, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := file.Stat(); err == nil && info.IsDir() {
+		file.Close()
+		return nil, fs.ErrNotExist
+	}
+	return file, nil
+}
+
+// Serves the static/ directory of the assets
+func staticFS(assets fs.FS) http.FileSystem {
+	sub, err := fs.Sub(assets, "static")
+	if err != nil {
+		fatal("error while opening static assets", "err", err)
+	}
+	return http.FS(staticFiles{sub})
+}
+
+// Parses templates/*.html once, or on every lookup in dev mode so edits show up on reload
+// Doubles as gin's HTML renderer
+type Templates struct {
+	assets fs.FS
+	funcs  template.FuncMap
+	dev    bool
+
+	once   sync.Once
+	parsed *template.Template
+}
+
+func NewTemplates(assets fs.FS, funcs template.FuncMap, dev bool) *Templates {
+	t := &Templates{assets: assets, funcs: funcs, dev: dev}
+	// Failing at startup rather than on the first request
+	t.Get()
+	return t
+}
+
+func (t *Templates) parse() *template.Template {
+	return template.Must(template.New("all").Funcs(t.funcs).ParseFS(t.assets, "templates/*.html"))
+}
+
+func (t *Templates) Get() *template.Template {
+	if t.dev {
+		return t.parse()
+	}
+	t.once.Do(func() {
+		t.parsed = t.parse()
+	})
+	return t.parsed
+}
+
+func (t *Templates) Instance(name string, data any) render.Render {
+	return render.HTML{Template: t.Get(), Name: name, Data: data}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tracks what clients last saw of each cell so board updates only carry the
+// cells that changed, as out-of-band swaps keyed by cell ID
+type BoardDiff struct {
+	mu sync.Mutex
+	// Cell value -> key of the cell as last sent
+	last map[int]string
+	// Board updates since the last full render
+	sinceFull int
+	// Every fullEvery-th update is a full render as a correctness fallback
+	fullEvery int
+}
+
+func NewBoardDiff(fullEvery int) *BoardDiff {
+	return &BoardDiff{
+		fullEvery: fullEvery,
+	}
+}
+
+// Everything that affects how a cell renders
+func cellKey(cell Cell) string {
+	var sb strings.Builder
+	sb.WriteString(cell.Color)
+	if cell.IsPortal {
+		sb.WriteString("|portal")
+	}
+	for _, p := range cell.Players {
+		sb.WriteString("|")
+		sb.WriteString(p.ID)
+		sb.WriteString("=")
+		sb.WriteString(p.Name)
+	}
+	return sb.String()
+}
+
+// Forces the next board update to be a full render
+func (d *BoardDiff) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.last = nil
+}
+
+// Compares the board against what was last sent
+// returns the changed cells, or full=true when a full render should be sent instead
+func (d *BoardDiff) Changed(board [][]Cell) (changed []Cell, full bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	next := make(map[int]string, len(board)*len(board))
+	for _, row := range board {
+		for _, cell := range row {
+			key := cellKey(cell)
+			next[cell.Value] = key
+			if prev, ok := d.last[cell.Value]; !ok || prev != key {
+				changed = append(changed, cell)
+			}
+		}
+	}
+
+	d.sinceFull++
+	full = d.last == nil || len(d.last) != len(next) || (d.fullEvery > 0 && d.sinceFull >= d.fullEvery)
+	if full {
+		d.sinceFull = 0
+	}
+	d.last = next
+	return changed, full
+}
+
+// Full board, or only the changed cells as a board-delta event
+func (h *GameHandler) renderBoardUpdate(snap *GameSnapshot) Message {
+	changed, full := h.BoardDiff.Changed(snap.Board)
+	if full {
+		return Message{Event: "board", Data: h.renderTopic(snap, "board", "")}
+	}
+
+	var sb strings.Builder
+	for _, cell := range changed {
+		sb.WriteString(h.Render("_cell.html", gin.H{"Cell": cell, "OOB": true}))
+	}
+	return Message{Event: "board-delta", Data: sb.String()}
+}
+
+// Full board fragment for clients that want to re-sync on demand
+func (h *GameHandler) GetBoard(c *gin.Context) {
+	c.HTML(http.StatusOK, "_board.html", gin.H{"Game": h.Game.Snapshot()})
+}
@@ -1,52 +1,518 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
-type Broker struct {
+// A single event fanned out to subscribers, independent of transport
+type Message struct {
+	ID    uint64 `json:"id,omitempty"`
+	Event string `json:"event,omitempty"`
+	Data  string `json:"data,omitempty"`
+	// Set for per-recipient messages, To is the player ID they were rendered for
+	Targeted bool   `json:"targeted,omitempty"`
+	To       string `json:"to,omitempty"`
+	// Set when several events travel together and must be written in one go
+	Batch []Message `json:"batch,omitempty"`
+}
+
+func (m Message) visibleTo(playerID string) bool {
+	return !m.Targeted || m.To == playerID
+}
+
+// Encodes the message as an SSE frame, batches become consecutive frames
+func (m Message) SSE() string {
+	if m.Batch != nil {
+		var sb strings.Builder
+		for _, msg := range m.Batch {
+			sb.WriteString(msg.SSE())
+		}
+		return sb.String()
+	}
+	return convert2sseEvent(eventID(m.ID), m.Event, m.Data)
+}
+
+// Random per process, so IDs from a previous run or another instance never
+// look like IDs from this one
+var eventEpoch = newEventEpoch()
+
+func newEventEpoch() string {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// SSE id of a broadcast, "<epoch>-<n>"; 0 means no id
+func eventID(id uint64) string {
+	if id == 0 {
+		return ""
+	}
+	return eventEpoch + "-" + strconv.FormatUint(id, 10)
+}
+
+// Counter of an SSE id sent by this process, false for other epochs or garbage
+func parseEventID(lastEventID string) (uint64, bool) {
+	epoch, n, found := strings.Cut(lastEventID, "-")
+	if !found || epoch != eventEpoch {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(n, 10, 64)
+	return id, err == nil
+}
+
+// Single events, with batches flattened
+func (m Message) Events() []Message {
+	if m.Batch != nil {
+		return m.Batch
+	}
+	return []Message{m}
+}
+
+// Per-subscriber bookkeeping
+type subscriber struct {
+	playerID string
+	// Topics the subscriber asked for, empty means every topic
+	topics []string
+	// Broadcasts dropped in a row because the channel was full
+	drops int
+	// Broadcasts dropped over the subscriber's lifetime
+	dropped uint64
+	// Set once a broadcast is dropped, cleared when the resync is taken
+	behind bool
+}
+
+type brokerStats struct {
+	heartbeats atomic.Uint64
+	evictions  atomic.Uint64
+	drops      atomic.Uint64
+	resyncs    atomic.Uint64
+	// Event -> broadcasts published, guarded by the broker lock
+	broadcasts map[string]uint64
+}
+
+// Point-in-time copy of the broker counters
+type BrokerStats struct {
+	Clients    int
+	Heartbeats uint64
+	Evictions  uint64
+	Drops      uint64
+	Resyncs    uint64
+	// Event -> broadcasts published, per-recipient copies count once
+	Broadcasts map[string]uint64
+}
+
+// One open /events or /ws stream, as listed in the admin console
+type Connection struct {
+	PlayerID string   `json:"player_id"`
+	Topics   []string `json:"topics"`
+	Dropped  uint64   `json:"dropped"`
+	Behind   bool     `json:"behind"`
+}
+
+// Fans events out to the /events and /ws subscribers
+// LocalBroker serves one process; HubBroker also relays through a broker hub so
+// several instances behind a load balancer see each other's broadcasts
+type Broker interface {
+	// Subscriber registration, see LocalBroker.Subscribe for the replay contract
+	Add(c chan Message, playerID string, topics []string)
+	Subscribe(c chan Message, playerID string, topics []string, lastEventID string) ([]Message, uint64, bool)
+	Remove(c chan Message)
+	Evict(c chan Message, reason error)
+	TakeResync(c chan Message) (uint64, bool)
+
+	// Audience of an event
+	Wants(event string) bool
+	PlayerIDs(event string) []string
+
+	// Publishing
+	Broadcast(event, html string)
+	BroadcastBatch(msgs []Message)
+	SendTo(playerID, event, html string)
+	BroadcastEach(event string, render func(playerID string) string)
+
+	CountHeartbeat()
+	Stats() BrokerStats
+	// Streams open on this instance
+	Connections() []Connection
+}
+
+// In-process Broker: a map of subscriber channels
+type LocalBroker struct {
 	mu      sync.Mutex
-	clients map[chan string]struct{}
+	clients map[chan Message]*subscriber
+	// Subscribers indexed by topic, events outside Topics go to every client
+	byTopic map[string]map[chan Message]*subscriber
+
+	// Every broadcast gets the next ID; the latest ones are kept for replay
+	lastID     uint64
+	history    []Message
+	replaySize int
+
+	// A subscriber that drops this many broadcasts in a row is considered dead
+	maxDrops int
+
+	stats brokerStats
 }
 
-func NewBroker() *Broker {
-	return &Broker{
-		clients: map[chan string]struct{}{},
+func NewLocalBroker(cfg *Config) *LocalBroker {
+	byTopic := make(map[string]map[chan Message]*subscriber, len(Topics))
+	for _, topic := range Topics {
+		byTopic[topic] = map[chan Message]*subscriber{}
+	}
+
+	return &LocalBroker{
+		clients:    map[chan Message]*subscriber{},
+		byTopic:    byTopic,
+		replaySize: cfg.SSEReplaySize,
+		maxDrops:   cfg.SSEMaxDrops,
+		stats:      brokerStats{broadcasts: map[string]uint64{}},
 	}
 }
 
-func (b *Broker) Add(c chan string) {
+func (b *LocalBroker) Add(c chan Message, playerID string, topics []string) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	b.clients[c] = struct{}{}
+	b.register(c, &subscriber{playerID: playerID, topics: topics})
 }
 
-func (b *Broker) Remove(c chan string) {
+func (b *LocalBroker) register(c chan Message, sub *subscriber) {
+	b.clients[c] = sub
+	topics := sub.topics
+	if len(topics) == 0 {
+		topics = Topics
+	}
+	for _, topic := range topics {
+		b.byTopic[topic][c] = sub
+	}
+}
+
+// Subscribers interested in the event
+func (b *LocalBroker) recipients(event string) map[chan Message]*subscriber {
+	if subs, ok := b.byTopic[topicOf(event)]; ok {
+		return subs
+	}
+	return b.clients
+}
+
+func (sub *subscriber) wants(event string) bool {
+	if len(sub.topics) == 0 {
+		return true
+	}
+	event = topicOf(event)
+	for _, topic := range sub.topics {
+		if topic == event {
+			return true
+		}
+	}
+	// Events that aren't topics are always delivered
+	for _, topic := range Topics {
+		if topic == event {
+			return false
+		}
+	}
+	return true
+}
+
+// Distinct player IDs of the subscribers that would receive the event
+func (b *LocalBroker) PlayerIDs(event string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	seen := map[string]bool{}
+	ids := []string{}
+	for _, sub := range b.recipients(event) {
+		if !seen[sub.playerID] {
+			seen[sub.playerID] = true
+			ids = append(ids, sub.playerID)
+		}
+	}
+	return ids
+}
+
+// Reports whether anyone would receive the event
+func (b *LocalBroker) Wants(event string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.recipients(event)) > 0
+}
+
+// Registers the channel and collects the messages sent after lastEventID
+// returns the missed messages, the current last ID and whether a replay is possible
+// If the client is too far behind, or its ID is from another run or instance, resumed is false
+// and the caller should send a full snapshot instead
+func (b *LocalBroker) Subscribe(c chan Message, playerID string, topics []string, lastEventID string) ([]Message, uint64, bool) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	sub := &subscriber{playerID: playerID, topics: topics}
+	b.register(c, sub)
+
+	if lastEventID == "" {
+		return nil, b.lastID, false
+	}
+	since, ok := parseEventID(lastEventID)
+	if !ok || since > b.lastID {
+		return nil, b.lastID, false
+	}
+	if since == b.lastID {
+		return nil, b.lastID, true
+	}
+
+	// The oldest kept message must directly follow what the client has seen
+	if len(b.history) == 0 || b.history[0].ID > since+1 {
+		return nil, b.lastID, false
+	}
+
+	missed := []Message{}
+	for _, msg := range b.history {
+		if msg.ID > since && msg.visibleTo(playerID) && sub.wants(msg.Event) {
+			missed = append(missed, msg)
+		}
+	}
+	return missed, b.lastID, true
+}
+
+// Safe to call more than once for the same channel
+func (b *LocalBroker) Remove(c chan Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(c)
+}
 
+func (b *LocalBroker) remove(c chan Message) bool {
+	if _, ok := b.clients[c]; !ok {
+		return false
+	}
 	delete(b.clients, c)
+	for _, subs := range b.byTopic {
+		delete(subs, c)
+	}
 	close(c)
+	return true
+}
+
+// Drops a subscriber whose connection failed and records why
+func (b *LocalBroker) Evict(c chan Message, reason error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.evict(c, reason)
+}
+
+func (b *LocalBroker) evict(c chan Message, reason error) {
+	sub, ok := b.clients[c]
+	if !ok || !b.remove(c) {
+		return
+	}
+	evictions := b.stats.evictions.Add(1)
+	slog.Warn("evicted subscriber", "action", "evict", "player_id", sub.playerID, "reason", reason,
+		"clients", len(b.clients), "evictions", evictions, "heartbeats", b.stats.heartbeats.Load())
+}
+
+func (b *LocalBroker) CountHeartbeat() {
+	b.stats.heartbeats.Add(1)
+}
+
+func (b *LocalBroker) Stats() BrokerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	broadcasts := make(map[string]uint64, len(b.stats.broadcasts))
+	for event, n := range b.stats.broadcasts {
+		broadcasts[event] = n
+	}
+	return BrokerStats{
+		Clients:    len(b.clients),
+		Heartbeats: b.stats.heartbeats.Load(),
+		Evictions:  b.stats.evictions.Load(),
+		Drops:      b.stats.drops.Load(),
+		Resyncs:    b.stats.resyncs.Load(),
+		Broadcasts: broadcasts,
+	}
+}
+
+func (b *LocalBroker) Connections() []Connection {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	conns := make([]Connection, 0, len(b.clients))
+	for _, sub := range b.clients {
+		conns = append(conns, Connection{
+			PlayerID: sub.playerID,
+			Topics:   append([]string{}, sub.topics...),
+			Dropped:  sub.dropped,
+			Behind:   sub.behind,
+		})
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].PlayerID < conns[j].PlayerID })
+	return conns
 }
 
-func convert2sseEvent(event, html string) string {
+// Reports whether the subscriber missed broadcasts and has now drained its channel
+// Only one resync is handed out per backlog, so callers re-render everything once
+// returns the current last ID for the resync to carry
+func (b *LocalBroker) TakeResync(c chan Message) (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub, ok := b.clients[c]
+	if !ok || !sub.behind || len(c) > 0 {
+		return 0, false
+	}
+	sub.behind = false
+	resyncs := b.stats.resyncs.Add(1)
+	slog.Info("resyncing subscriber", "action", "resync", "player_id", sub.playerID, "dropped", sub.dropped, "resyncs", resyncs)
+	return b.lastID, true
+}
+
+func convert2sseEvent(id, event, html string) string {
 	html = strings.ReplaceAll(html, "\r\n", "\n")
 	html = strings.ReplaceAll(html, "\n", "\ndata: ")
-	return fmt.Sprintf("event: %v\ndata: %v\n\n", event, html)
+	if id == "" {
+		return fmt.Sprintf("event: %v\ndata: %v\n\n", event, html)
+	}
+	return fmt.Sprintf("id: %v\nevent: %v\ndata: %v\n\n", id, event, html)
+}
+
+// Keeps the message for Last-Event-ID replays, bounded to replaySize
+func (b *LocalBroker) record(msg Message) {
+	if b.replaySize <= 0 {
+		return
+	}
+	if len(b.history) >= b.replaySize {
+		b.history = append(b.history[:0], b.history[len(b.history)-b.replaySize+1:]...)
+	}
+	b.history = append(b.history, msg)
+}
+
+// Non-blocking send that tracks drops for resync and eviction
+func (b *LocalBroker) deliver(ch chan Message, sub *subscriber, msg Message) {
+	// Sending data to active players (channels) which can take data
+	select {
+	case ch <- msg:
+		sub.drops = 0
+	default:
+		sub.drops++
+		sub.dropped++
+		sub.behind = true
+		b.stats.drops.Add(1)
+		if b.maxDrops > 0 && sub.drops >= b.maxDrops {
+			b.evict(ch, fmt.Errorf("%v broadcasts dropped in a row", sub.drops))
+		}
+	}
+}
+
+func (b *LocalBroker) Broadcast(event, html string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	b.stats.broadcasts[event]++
+	msg := Message{ID: b.lastID, Event: event, Data: html}
+	b.record(msg)
+
+	for ch, sub := range b.recipients(event) {
+		b.deliver(ch, sub, msg)
+	}
+}
+
+// Sends several events as one batch per subscriber
+// Each event gets its own ID (per-recipient copies of an event share one) and
+// every subscriber receives only the events it can see, in a single channel slot
+func (b *LocalBroker) BroadcastBatch(msgs []Message) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ids := map[string]uint64{}
+	for i := range msgs {
+		id, ok := ids[msgs[i].Event]
+		if !ok || !msgs[i].Targeted {
+			b.lastID++
+			b.stats.broadcasts[msgs[i].Event]++
+			id = b.lastID
+			ids[msgs[i].Event] = id
+		}
+		msgs[i].ID = id
+		b.record(msgs[i])
+	}
+
+	// Only the subscribers of each event's topic, found through the index
+	batches := map[chan Message][]Message{}
+	subs := map[chan Message]*subscriber{}
+	for _, msg := range msgs {
+		for ch, sub := range b.recipients(msg.Event) {
+			if msg.visibleTo(sub.playerID) {
+				batches[ch] = append(batches[ch], msg)
+				subs[ch] = sub
+			}
+		}
+	}
+	for ch, batch := range batches {
+		b.deliver(ch, subs[ch], Message{Batch: batch})
+	}
 }
 
-func (b *Broker) Broadcast(event, html string) {
-	msg := convert2sseEvent(event, html)
+// Sends the event only to the subscribers registered with the given player ID
+func (b *LocalBroker) SendTo(playerID, event, html string) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	for ch := range b.clients {
-		// Sending data to active players (channels) which can take data
-		select {
-		case ch <- msg:
-		default:
+	b.lastID++
+	b.stats.broadcasts[event]++
+	msg := Message{ID: b.lastID, Event: event, Data: html, Targeted: true, To: playerID}
+	b.record(msg)
+
+	for ch, sub := range b.recipients(event) {
+		if sub.playerID == playerID {
+			b.deliver(ch, sub, msg)
+		}
+	}
+}
+
+// Renders the event once per connected player and sends each subscriber its own copy
+// Rendering happens outside the broker lock; subscribers that connect meanwhile
+// already got the current state in their initial snapshot
+func (b *LocalBroker) BroadcastEach(event string, render func(playerID string) string) {
+	b.mu.Lock()
+	recipients := map[string]string{}
+	for _, sub := range b.recipients(event) {
+		recipients[sub.playerID] = ""
+	}
+	b.mu.Unlock()
+
+	if len(recipients) == 0 {
+		return
+	}
+
+	for playerID := range recipients {
+		recipients[playerID] = render(playerID)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// One ID for the whole event, each recipient's copy is kept for replay
+	b.lastID++
+	b.stats.broadcasts[event]++
+	for playerID, html := range recipients {
+		b.record(Message{ID: b.lastID, Event: event, Data: html, Targeted: true, To: playerID})
+	}
+
+	for ch, sub := range b.recipients(event) {
+		html, ok := recipients[sub.playerID]
+		if !ok {
+			continue
 		}
+		b.deliver(ch, sub, Message{ID: b.lastID, Event: event, Data: html, Targeted: true, To: sub.playerID})
 	}
 }
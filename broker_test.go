@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSubscribeResume(t *testing.T) {
+	b := NewLocalBroker(&Config{SSEReplaySize: 16, SSEMaxDrops: 4})
+	for range 3 {
+		b.Broadcast("stream", "<li>roll</li>")
+	}
+
+	tests := []struct {
+		name        string
+		lastEventID string
+		missed      int
+		resumed     bool
+	}{
+		{name: "fresh", lastEventID: "", resumed: false},
+		{name: "behind", lastEventID: eventID(1), missed: 2, resumed: true},
+		{name: "up to date", lastEventID: eventID(3), resumed: true},
+		{name: "ahead", lastEventID: eventID(4), resumed: false},
+		{name: "other epoch", lastEventID: "0000-1", resumed: false},
+		{name: "previous format", lastEventID: "1", resumed: false},
+		{name: "garbage", lastEventID: eventEpoch + "-x", resumed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := make(chan Message, 8)
+			defer b.Remove(ch)
+
+			missed, lastID, resumed := b.Subscribe(ch, "p1", nil, tt.lastEventID)
+			if resumed != tt.resumed || len(missed) != tt.missed || lastID != 3 {
+				t.Fatalf("Subscribe(%q) = %v missed, last %v, resumed %v; want %v missed, last 3, resumed %v",
+					tt.lastEventID, len(missed), lastID, resumed, tt.missed, tt.resumed)
+			}
+		})
+	}
+}
+
+func TestSSEFrameCarriesEpoch(t *testing.T) {
+	frame := Message{ID: 7, Event: "stream", Data: "x"}.SSE()
+	if !strings.HasPrefix(frame, "id: "+eventEpoch+"-7\n") {
+		t.Fatalf("frame has no epoch-prefixed id:\n%s", frame)
+	}
+	if frame := (Message{Event: "stream", Data: "x"}).SSE(); strings.HasPrefix(frame, "id:") {
+		t.Fatalf("message without an ID got one:\n%s", frame)
+	}
+}
+
+func TestBroadcastBatchFollowsTopics(t *testing.T) {
+	b := NewLocalBroker(&Config{SSEReplaySize: 16, SSEMaxDrops: 4})
+	all, stream, dice := make(chan Message, 1), make(chan Message, 1), make(chan Message, 1)
+	b.Add(all, "p1", nil)
+	b.Add(stream, "p1", []string{"stream"})
+	b.Add(dice, "p2", []string{"dice"})
+
+	b.BroadcastBatch([]Message{
+		{Event: "stream", Data: "s"},
+		{Event: "dice", Data: "d1", Targeted: true, To: "p1"},
+		{Event: "board", Data: "b"},
+		{Event: "restarting", Data: "r"},
+	})
+
+	tests := []struct {
+		name string
+		ch   chan Message
+		want []string
+	}{
+		{name: "every topic", ch: all, want: []string{"stream", "dice", "board", "restarting"}},
+		{name: "stream only", ch: stream, want: []string{"stream", "restarting"}},
+		{name: "someone else's dice", ch: dice, want: []string{"restarting"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			select {
+			case msg := <-tt.ch:
+				for _, ev := range msg.Events() {
+					got = append(got, ev.Event)
+				}
+			default:
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* Room ownership: with a broker hub only the owning instance mutates the Game,
+   the others proxy game requests to it, fan out events and keep a replica of
+   the game from the events the owner sends through the hub */
+
+var (
+	errNotOwner = fmt.Errorf("Game is served by another instance")
+	errNoOwner  = fmt.Errorf("No instance owns the game right now, try again shortly")
+)
+
+// Game state that moves between instances together with ownership
+type Replica interface {
+	// Events of the current game applied on this instance
+	Version() uint64
+	// Applies events the owner sent through the hub, version counts them in
+	ApplyReplica(gameID string, version uint64, entries []LoggedEvent)
+	// Fetches whatever the owner has that this instance lacks
+	CatchUp()
+}
+
+type Cluster struct {
+	Instance string
+	URL      string
+	// Sent with calls to the owner's /internal/ endpoints, which only trust them with it
+	secret string
+	// Set with BROKER_HUB_ADDR, ownership then comes from the hub
+	hub bool
+
+	mu       sync.Mutex
+	ownerID  string
+	ownerURL string
+	proxy    *httputil.ReverseProxy
+	client   *http.Client
+
+	replica Replica
+	// Sends a frame to the hub, set by the hub broker
+	send func(frame hubFrame)
+}
+
+func NewCluster(cfg *Config) *Cluster {
+	instance := cfg.InstanceID
+	if instance == "" {
+		host, _ := os.Hostname()
+		instance = fmt.Sprintf("%v:%v", host, cfg.Port)
+	}
+	selfURL := cfg.InstanceURL
+	if selfURL == "" {
+		selfURL = fmt.Sprintf("http://localhost:%v", cfg.Port)
+	}
+
+	return &Cluster{
+		Instance: instance,
+		URL:      strings.TrimRight(selfURL, "/"),
+		secret:   cfg.ClusterSecret,
+		hub:      cfg.BrokerHubAddr != "",
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Records the owner announced by the hub
+// An empty owner means nobody owns the game, as while the hub is unreachable or
+// picks a new owner; with a hub nothing is mutated until one is known
+func (c *Cluster) SetOwner(instance, ownerURL string) {
+	c.mu.Lock()
+	if c.ownerID == instance && c.ownerURL == ownerURL {
+		c.mu.Unlock()
+		return
+	}
+	c.ownerID = instance
+	c.ownerURL = strings.TrimRight(ownerURL, "/")
+	c.proxy = nil
+	following := c.follower()
+	if following {
+		if target, err := url.Parse(c.ownerURL); err == nil {
+			c.proxy = httputil.NewSingleHostReverseProxy(target)
+		}
+	}
+	replica := c.replica
+	c.mu.Unlock()
+
+	slog.Info("game owner changed", "action", "claim", "instance", c.Instance, "owner", instance, "url", ownerURL)
+	// A new follower brings its replica up to the owner's game
+	if following && replica != nil {
+		replica.CatchUp()
+	}
+}
+
+func (c *Cluster) follower() bool {
+	return c.ownerID != "" && c.ownerID != c.Instance && c.ownerURL != ""
+}
+
+// Reports whether another instance owns the game
+// returns the owner's base URL when it does
+func (c *Cluster) Follower() (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ownerURL, c.follower()
+}
+
+// Reports whether this instance may mutate the game
+// errNotOwner when another instance owns it, errNoOwner while the owner is unknown
+func (c *Cluster) Writable() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.follower() {
+		return errNotOwner
+	}
+	if c.hub && c.ownerID != c.Instance {
+		return errNoOwner
+	}
+	return nil
+}
+
+// Reports whether this instance owns the game and its events go to the followers
+func (c *Cluster) Leading() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hub && c.ownerID == c.Instance
+}
+
+// Wires the game state that moves with ownership
+func (c *Cluster) Attach(replica Replica) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replica = replica
+}
+
+// Events of the game applied here, claims with fewer are granted last
+func (c *Cluster) Version() uint64 {
+	c.mu.Lock()
+	replica := c.replica
+	c.mu.Unlock()
+	if replica == nil {
+		return 0
+	}
+	return replica.Version()
+}
+
+// Sends the owner's events to the followers through the hub
+func (c *Cluster) Replicate(gameID string, version uint64, entries []LoggedEvent) {
+	c.mu.Lock()
+	send := c.send
+	c.mu.Unlock()
+	if send != nil {
+		send(hubFrame{Type: "events", Room: defaultRoom, GameID: gameID, Version: version, Events: entries})
+	}
+}
+
+// Hands events from the owner to the replica
+func (c *Cluster) receive(frame hubFrame) {
+	c.mu.Lock()
+	replica := c.replica
+	c.mu.Unlock()
+	if replica != nil {
+		replica.ApplyReplica(frame.GameID, frame.Version, frame.Events)
+	}
+}
+
+// Reports whether the request comes from another instance of the cluster
+func (c *Cluster) Trusted(ctx *gin.Context) bool {
+	return c != nil && secretEqual(ctx.GetHeader("X-Cluster-Secret"), c.secret)
+}
+
+// Middleware that keeps the /internal/ endpoints to the instances of the cluster
+func (c *Cluster) InternalOnly() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !c.Trusted(ctx) {
+			apiError(ctx, http.StatusForbidden, fmt.Errorf("Cluster secret required"))
+			ctx.Abort()
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// Middleware that hands the request to the owning instance when this one follows
+// This is the only way player actions reach the owner: pages, forms, the JSON
+// API and /ws (which carries commands) all go through it, cookies and tokens included
+// /events is served locally, its events reach it through the hub
+func (c *Cluster) RouteToOwner() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		path := ctx.Request.URL.Path
+		// SSE streams, static files and the probes and metrics of this instance stay local
+		if path == "/events" || path == "/healthz" || path == "/readyz" || path == "/metrics" ||
+			strings.HasPrefix(path, "/static/") || strings.HasPrefix(path, "/internal/") {
+			ctx.Next()
+			return
+		}
+
+		c.mu.Lock()
+		proxy := c.proxy
+		c.mu.Unlock()
+		if proxy == nil {
+			ctx.Next()
+			return
+		}
+
+		proxy.ServeHTTP(ctx.Writer, ctx.Request)
+		ctx.Abort()
+	}
+}
+
+// Reads one of the owner's /internal/ endpoints, decoding into out
+func (c *Cluster) get(path string, out any) error {
+	ownerURL, ok := c.Follower()
+	if !ok {
+		return fmt.Errorf("No owner to ask")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, ownerURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Cluster-Secret", c.secret)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr APIError
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			return fmt.Errorf("Owner returned %v", resp.Status)
+		}
+		return fmt.Errorf("%v", apiErr.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Fragments rendered by the owner, for a follower's initial snapshot and resyncs
+func (c *Cluster) Fragments(playerID string, topics []string) ([]Message, error) {
+	var msgs []Message
+	path := "/internal/fragments?me=" + url.QueryEscape(playerID) + "&topics=" + url.QueryEscape(strings.Join(topics, ","))
+	err := c.get(path, &msgs)
+	return msgs, err
+}
+
+// Renders the requested topics from this instance's game
+func (h *GameHandler) InternalFragments(c *gin.Context) {
+	topics, err := ParseTopics(c.Query("topics"))
+	if err != nil {
+		apiError(c, http.StatusBadRequest, err)
+		return
+	}
+	c.JSON(http.StatusOK, h.renderInitialEvents(c.Query("me"), topics))
+}
+
+// The owner's game as a follower fetches it to catch up
+type ReplicaState struct {
+	GameID  string        `json:"game_id"`
+	Version uint64        `json:"version"`
+	Events  []LoggedEvent `json:"events"`
+}
+
+// Logged events of the current game after the given count
+// The whole game, from GameCreated, when the caller replicates another game or is ahead
+func (h *GameHandler) InternalEvents(c *gin.Context) {
+	after, _ := strconv.ParseUint(c.Query("after"), 10, 64)
+
+	var gameID string
+	h.Engine.Exec(func(game *Game) { gameID = game.ID })
+	entries, err := ReadEventLog(h.Log.Path())
+	if err != nil && !os.IsNotExist(err) {
+		apiError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	events := []LoggedEvent{}
+	for _, entry := range entries {
+		if entry.GameID == gameID {
+			events = append(events, entry)
+		}
+	}
+	if c.Query("game") != gameID || after > uint64(len(events)) {
+		after = 0
+	}
+	c.JSON(http.StatusOK, ReplicaState{GameID: gameID, Version: uint64(len(events)), Events: events[after:]})
+}
+
+// Replicates every command's events to the followers, right after they are logged
+func (h *GameHandler) replicate(events []DomainEvent) {
+	if !h.Cluster.Leading() {
+		return
+	}
+	entries := make([]LoggedEvent, 0, len(events))
+	for _, ev := range events {
+		entry, err := newLoggedEvent(0, h.Game.ID, ev)
+		if err != nil {
+			slog.Error("error while replicating events", "game_id", h.Game.ID, "action", "replicate", "event", ev.EventName(), "err", err)
+			return
+		}
+		entries = append(entries, entry)
+	}
+	h.Cluster.Replicate(h.Game.ID, h.version.Load(), entries)
+}
+
+// Counted by record, restored by Recover
+func (h *GameHandler) Version() uint64 {
+	return h.version.Load()
+}
+
+// Applies the events when they follow the local ones, catches up otherwise
+func (h *GameHandler) ApplyReplica(gameID string, version uint64, entries []LoggedEvent) {
+	// A running catch-up fetches these as well
+	if h.catchingUp.Load() {
+		return
+	}
+	h.replicaMu.Lock()
+	defer h.replicaMu.Unlock()
+	if h.Cluster.Leading() {
+		return
+	}
+
+	var current string
+	h.Engine.Exec(func(game *Game) { current = game.ID })
+	local := h.version.Load()
+	switch {
+	case gameID == current && version <= local:
+		// Already applied
+		return
+	case gameID != current || version != local+uint64(len(entries)):
+		slog.Warn("replica out of step with the owner", "game_id", current, "action", "replicate", "version", local, "owner_game_id", gameID, "owner_version", version)
+		h.CatchUp()
+		return
+	}
+	if err := h.applyReplica(entries); err != nil {
+		slog.Error("error while applying replicated events", "game_id", gameID, "action", "replicate", "version", version, "err", err)
+	}
+}
+
+// Fetches the owner's missing events in the background, one fetch at a time
+func (h *GameHandler) CatchUp() {
+	if !h.catchingUp.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer h.catchingUp.Store(false)
+		h.replicaMu.Lock()
+		defer h.replicaMu.Unlock()
+		if err := h.catchUp(); err != nil {
+			slog.Warn("error while catching up with the owner", "game_id", h.Game.ID, "action", "replicate", "err", err)
+		}
+	}()
+}
+
+func (h *GameHandler) catchUp() error {
+	var current string
+	h.Engine.Exec(func(game *Game) { current = game.ID })
+	local := h.version.Load()
+
+	var state ReplicaState
+	path := "/internal/events?game=" + url.QueryEscape(current) + "&after=" + strconv.FormatUint(local, 10)
+	if err := h.Cluster.get(path, &state); err != nil {
+		return err
+	}
+	if err := h.applyReplica(state.Events); err != nil {
+		return err
+	}
+	slog.Info("caught up with the owner", "game_id", state.GameID, "action", "replicate", "version", state.Version, "events", len(state.Events))
+	return nil
+}
+
+// Applies the owner's events through the engine, so they are logged and observed here too
+func (h *GameHandler) applyReplica(entries []LoggedEvent) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	events := make([]DomainEvent, 0, len(entries))
+	for _, entry := range entries {
+		ev, err := entry.Event()
+		if err != nil {
+			return err
+		}
+		events = append(events, ev)
+	}
+	_, err := h.Engine.Do(replicaCmd{events: events})
+	return err
+}
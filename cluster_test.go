@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Follower proxying to an owner, both in this process
+func newTestCluster(t *testing.T) (owner, follower *GameHandler, followerURL string) {
+	t.Helper()
+	settings := map[string]string{"CLUSTER_SECRET": "s3cret"}
+
+	ownerRouter, owner := newTestHandler(t, settings)
+	ownerSrv := httptest.NewServer(ownerRouter)
+	t.Cleanup(ownerSrv.Close)
+
+	followerRouter, follower := newTestHandler(t, settings)
+	followerSrv := httptest.NewServer(followerRouter)
+	t.Cleanup(followerSrv.Close)
+
+	follower.Cluster.SetOwner("owner", ownerSrv.URL)
+	return owner, follower, followerSrv.URL
+}
+
+func TestFollowerProxiesActions(t *testing.T) {
+	owner, follower, url := newTestCluster(t)
+	token := newPlayerToken()
+
+	post := func(path, body string, headers map[string]string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, url+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for key, val := range headers {
+			req.Header.Set(key, val)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			t.Fatalf("%v: %v", path, resp.Status)
+		}
+	}
+
+	post("/api/v1/join", `{"name": "Bob"}`, map[string]string{"X-Player-Token": token})
+	post("/api/v1/roll", "", map[string]string{"X-Player-Token": token})
+
+	id := playerIDFromToken(token)
+	if player, ok := owner.Game.Snapshot().Players[id]; !ok || player.Name != "Bob" || player.Rolls != 1 {
+		t.Fatalf("owner has %+v, want Bob with one roll", player)
+	}
+	if _, err := follower.Engine.Join("p2", "Eve"); !errors.Is(err, errNotOwner) {
+		t.Fatalf("follower joined on its own game: %v", err)
+	}
+
+	// Knowing the secret and a public ID is no way to act for a player anymore
+	req, _ := http.NewRequest(http.MethodPost, url+"/api/v1/leave", nil)
+	req.Header.Set("X-Cluster-Secret", "s3cret")
+	req.Header.Set("X-Player-ID", id)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, ok := owner.Game.Snapshot().Players[id]; !ok || resp.StatusCode == http.StatusOK {
+		t.Fatalf("leave by X-Player-ID answered %v and removed the player", resp.Status)
+	}
+}
+
+func TestFollowerProxiesWebSocket(t *testing.T) {
+	owner, _, url := newTestCluster(t)
+	token := newPlayerToken()
+
+	header := http.Header{"X-Player-Token": {token}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws?topics=stream", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(WSIncoming{Type: "join", Name: "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var out WSOutgoing
+		if err := conn.ReadJSON(&out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Type == "error" {
+			t.Fatalf("join over the proxied socket failed: %v", out.Error)
+		}
+		if out.Type == "result" {
+			break
+		}
+	}
+
+	if player, ok := owner.Game.Snapshot().Players[playerIDFromToken(token)]; !ok || player.Name != "Ann" {
+		t.Fatalf("owner has %+v, want Ann", player)
+	}
+}
+
+// With a hub nothing is mutated until the hub names an owner
+func TestRefusesWithoutOwner(t *testing.T) {
+	_, h := newTestHandler(t, nil)
+	h.Cluster.hub = true
+
+	if _, err := h.Engine.Join("p1", "Bob"); !errors.Is(err, errNoOwner) {
+		t.Fatalf("join without an owner: %v, want %v", err, errNoOwner)
+	}
+	h.Cluster.SetOwner(h.Cluster.Instance, h.Cluster.URL)
+	if _, err := h.Engine.Join("p1", "Bob"); err != nil {
+		t.Fatalf("join as the owner: %v", err)
+	}
+}
+
+// A follower catches up with the owner's game, then applies what the owner replicates
+func TestFollowerReplicatesGame(t *testing.T) {
+	settings := map[string]string{"CLUSTER_SECRET": "s3cret"}
+	ownerRouter, owner := newTestHandler(t, settings)
+	ownerSrv := httptest.NewServer(ownerRouter)
+	t.Cleanup(ownerSrv.Close)
+	_, follower := newTestHandler(t, settings)
+
+	owner.Cluster.Instance, owner.Cluster.hub = "owner", true
+	owner.Cluster.SetOwner("owner", ownerSrv.URL)
+	if _, err := owner.Engine.Join("p1", "Bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	follower.Cluster.hub = true
+	follower.Cluster.SetOwner("owner", ownerSrv.URL)
+	deadline := time.Now().Add(2 * time.Second)
+	for follower.Version() != owner.Version() || follower.catchingUp.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower at version %v, owner at %v", follower.Version(), owner.Version())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Stands in for the hub
+	owner.Cluster.send = follower.Cluster.receive
+	if _, err := owner.Engine.Roll("p1"); err != nil {
+		t.Fatal(err)
+	}
+
+	want, got := owner.Game.Snapshot(), follower.Game.Snapshot()
+	if got.ID != want.ID || got.Players["p1"].Position != want.Players["p1"].Position || got.Players["p1"].Rolls != 1 {
+		t.Fatalf("follower has game %v with %+v, owner has %v with %+v", got.ID, got.Players["p1"], want.ID, want.Players["p1"])
+	}
+	if follower.Version() != owner.Version() {
+		t.Fatalf("follower at version %v, owner at %v", follower.Version(), owner.Version())
+	}
+}
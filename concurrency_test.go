@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// Joins, rolls, leaves, game reads and SSE streams all at once; run with -race
+// Every player still seated must be on the board exactly once, where their position says
+func TestConcurrentPlayers(t *testing.T) {
+	router, h := newTestHandler(t, nil)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	streams, stopStreams := context.WithCancel(t.Context())
+	var readers, players sync.WaitGroup
+
+	const clients = 8
+	ids := make([]string, clients)
+	for i := range clients {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Jar: jar}
+
+		// Picking up the player cookie
+		if err := expectOK(client.Get(srv.URL + "/")); err != nil {
+			t.Fatal(err)
+		}
+		base, _ := url.Parse(srv.URL)
+		for _, cookie := range jar.Cookies(base) {
+			if cookie.Name == playerCookie {
+				ids[i] = playerIDFromToken(cookie.Value)
+			}
+		}
+		if ids[i] == "" {
+			t.Fatal("no player cookie set")
+		}
+
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			req, _ := http.NewRequestWithContext(streams, http.MethodGet, srv.URL+"/events", nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+
+			scanner := bufio.NewScanner(resp.Body)
+			scanner.Buffer(nil, 1<<20)
+			for scanner.Scan() {
+			}
+		}()
+
+		players.Add(1)
+		go func() {
+			defer players.Done()
+			// A refused join re-renders the form with a 200, so the game is checked below
+			form := url.Values{"player_name": {fmt.Sprintf("Player %v", i)}}
+			if err := expectOK(client.PostForm(srv.URL+"/join", form)); err != nil {
+				t.Error(err)
+				return
+			}
+
+			for range 15 {
+				if err := expectOK(client.Get(srv.URL + "/dice-roll")); err != nil {
+					t.Error(err)
+					return
+				}
+
+				resp, err := client.Get(srv.URL + "/api/v1/game")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var game APIGameState
+				err = json.NewDecoder(resp.Body).Decode(&game)
+				resp.Body.Close()
+				if err != nil {
+					t.Errorf("decoding /api/v1/game: %v", err)
+					return
+				}
+			}
+
+			// Half of the players leave, freeing seats mid-game
+			if i%2 == 0 {
+				if err := expectOK(client.PostForm(srv.URL+"/leave", nil)); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+
+	players.Wait()
+	stopStreams()
+	readers.Wait()
+
+	snap := h.Game.Snapshot()
+	for i, id := range ids {
+		player, seated := snap.Players[id]
+		if i%2 == 0 {
+			if seated {
+				t.Errorf("player %v left but is still seated", id)
+			}
+			continue
+		}
+
+		if !seated {
+			t.Errorf("player %v joined but is not seated", id)
+			continue
+		}
+		if want := fmt.Sprintf("Player %v", i); player.Name != want {
+			t.Errorf("player %v is named %q, want %q", id, player.Name, want)
+		}
+	}
+	if len(snap.Players) != clients/2 {
+		t.Errorf("%v players seated, want %v", len(snap.Players), clients/2)
+	}
+	if err := checkBoard(snap); err != nil {
+		t.Error(err)
+	}
+}
+
+// Verifies that every player is listed once, on the cell at their position
+func checkBoard(snap *GameSnapshot) error {
+	seen := map[string]Position{}
+	for r, row := range snap.Board {
+		for c, cell := range row {
+			pos := Position{Row: r, Col: c}
+			for _, p := range cell.Players {
+				if prev, dup := seen[p.ID]; dup {
+					return fmt.Errorf("player %v is on cells %v and %v", p.ID, prev, pos)
+				}
+				seen[p.ID] = pos
+
+				player, exists := snap.Players[p.ID]
+				if !exists {
+					return fmt.Errorf("cell %v lists unknown player %v", pos, p.ID)
+				}
+				if player.Position != pos {
+					return fmt.Errorf("player %v is at %v but listed on %v", p.ID, player.Position, pos)
+				}
+			}
+		}
+	}
+
+	for id := range snap.Players {
+		if _, ok := seen[id]; !ok {
+			return fmt.Errorf("player %v is on no cell", id)
+		}
+	}
+	return nil
+}
+
+// Reads the response and fails unless it is a 200
+func expectOK(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %v %s", resp.Request.URL.Path, resp.Status, body)
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joho/godotenv"
+)
+
+/* Configuration: defaults, then the config file, then the environment, then flags */
+
+type Config struct {
+	Port      int
+	GinMode   string
+	LogLevel  string
+	LogFormat string
+	// Templates and static files read from disk on every request instead of the binary
+	Dev bool
+
+	// Game
+	MaxPlayers        int
+	BoardDim          int
+	DiceDim           int
+	MaxPortals        int
+	DefaultCellColor  string
+	MaxStreams        int
+	MaxBestFinishes   int
+	MaxNameLen        int
+	NameBlocklistFile string
+
+	// Streaming
+	SSEReplaySize        int
+	SSEMaxDrops          int
+	SSEHeartbeat         time.Duration
+	SSERetry             time.Duration
+	SSEWriteTimeout      time.Duration
+	BroadcastDebounce    time.Duration
+	BoardFullRenderEvery int
+
+	// Storage and lifecycle
+	EventLogFile     string
+	LeaderboardFile  string
+	SnapshotFile     string
+	SnapshotInterval time.Duration
+	ShutdownTimeout  time.Duration
+
+	// Running several instances
+	BrokerHubAddr   string
+	BrokerHubListen string
+	InstanceID      string
+	InstanceURL     string
+	// Shared by the instances to trust each other's calls
+	ClusterSecret string
+
+	// Admin area, disabled unless a token or a user and password are set
+	AdminToken    string
+	AdminUser     string
+	AdminPassword string
+
+	// Where each setting came from: default, file, env or flag
+	sources map[string]string
+}
+
+// One setting: its env key, default and where it lands in Config
+type configVar struct {
+	key   string
+	def   string
+	usage string
+	// Parses the raw value into the Config
+	set func(cfg *Config, raw string) error
+	// Formats the Config value back, for --print-config
+	get func(cfg *Config) string
+	// Given as a bare flag, e.g. -dev
+	isBool bool
+}
+
+func intVar(key, def, usage string, field func(*Config) *int) configVar {
+	return configVar{
+		key: key, def: def, usage: usage,
+		set: func(cfg *Config, raw string) error {
+			val, err := strconv.Atoi(strings.TrimSpace(raw))
+			if err != nil {
+				return fmt.Errorf("%v: %q is not a number", key, raw)
+			}
+			*field(cfg) = val
+			return nil
+		},
+		get: func(cfg *Config) string { return strconv.Itoa(*field(cfg)) },
+	}
+}
+
+func stringVar(key, def, usage string, field func(*Config) *string) configVar {
+	return configVar{
+		key: key, def: def, usage: usage,
+		set: func(cfg *Config, raw string) error {
+			*field(cfg) = strings.TrimSpace(raw)
+			return nil
+		},
+		get: func(cfg *Config) string { return *field(cfg) },
+	}
+}
+
+func boolVar(key, def, usage string, field func(*Config) *bool) configVar {
+	return configVar{
+		key: key, def: def, usage: usage, isBool: true,
+		set: func(cfg *Config, raw string) error {
+			val, err := strconv.ParseBool(strings.TrimSpace(raw))
+			if err != nil {
+				return fmt.Errorf("%v: %q is not true or false", key, raw)
+			}
+			*field(cfg) = val
+			return nil
+		},
+		get: func(cfg *Config) string { return strconv.FormatBool(*field(cfg)) },
+	}
+}
+
+// Strings that are never printed, e.g. passwords
+func secretVar(key, def, usage string, field func(*Config) *string) configVar {
+	v := stringVar(key, def, usage, field)
+	v.get = func(cfg *Config) string {
+		if *field(cfg) == "" {
+			return ""
+		}
+		return "********"
+	}
+	return v
+}
+
+// Durations keep the unit in the key, e.g. SSE_RETRY_MS=3000
+func durationVar(key, def, usage string, unit time.Duration, field func(*Config) *time.Duration) configVar {
+	return configVar{
+		key: key, def: def, usage: usage,
+		set: func(cfg *Config, raw string) error {
+			val, err := strconv.Atoi(strings.TrimSpace(raw))
+			if err != nil {
+				return fmt.Errorf("%v: %q is not a number", key, raw)
+			}
+			*field(cfg) = time.Duration(val) * unit
+			return nil
+		},
+		get: func(cfg *Config) string { return strconv.FormatInt(int64(*field(cfg)/unit), 10) },
+	}
+}
+
+var configVars = []configVar{
+	intVar("PORT", "6699", "port to listen on", func(c *Config) *int { return &c.Port }),
+	stringVar("GIN_MODE", gin.DebugMode, "gin mode: debug, release or test", func(c *Config) *string { return &c.GinMode }),
+	stringVar("LOG_LEVEL", "info", "lowest level logged: debug, info, warn or error", func(c *Config) *string { return &c.LogLevel }),
+	stringVar("LOG_FORMAT", "text", "log output: text or json", func(c *Config) *string { return &c.LogFormat }),
+	boolVar("DEV", "false", "serve templates and static files from disk, reloaded on every request", func(c *Config) *bool { return &c.Dev }),
+
+	intVar("MAX_PLAYERS", "3", "expected number of players", func(c *Config) *int { return &c.MaxPlayers }),
+	intVar("BOARD_DIM", "10", "board rows and columns", func(c *Config) *int { return &c.BoardDim }),
+	intVar("DICE_DIM", "6", "faces on the dice", func(c *Config) *int { return &c.DiceDim }),
+	intVar("MAX_PORTALS", "30", "portals on the board", func(c *Config) *int { return &c.MaxPortals }),
+	stringVar("DEFAULT_CELL_COLOR", "#2b89e2", "color of cells without a portal", func(c *Config) *string { return &c.DefaultCellColor }),
+	intVar("MAX_STREAMS", "100", "stream messages kept", func(c *Config) *int { return &c.MaxStreams }),
+	intVar("MAX_BEST_FINISHES", "5", "leaderboard entries shown, 0 for all", func(c *Config) *int { return &c.MaxBestFinishes }),
+	intVar("MAX_NAME_LEN", "24", "longest player name", func(c *Config) *int { return &c.MaxNameLen }),
+	stringVar("NAME_BLOCKLIST_FILE", "", "file of words not allowed in names", func(c *Config) *string { return &c.NameBlocklistFile }),
+
+	intVar("SSE_REPLAY_SIZE", "256", "events kept for Last-Event-ID replays", func(c *Config) *int { return &c.SSEReplaySize }),
+	intVar("SSE_MAX_DROPS", "64", "dropped events before a slow client is evicted, 0 never evicts", func(c *Config) *int { return &c.SSEMaxDrops }),
+	durationVar("SSE_HEARTBEAT_SECONDS", "15", "interval between heartbeats, 0 disables them", time.Second, func(c *Config) *time.Duration { return &c.SSEHeartbeat }),
+	durationVar("SSE_RETRY_MS", "3000", "reconnect delay advertised to clients", time.Millisecond, func(c *Config) *time.Duration { return &c.SSERetry }),
+	durationVar("SSE_WRITE_TIMEOUT_SECONDS", "10", "slowest write before a client is dropped", time.Second, func(c *Config) *time.Duration { return &c.SSEWriteTimeout }),
+	durationVar("BROADCAST_DEBOUNCE_MS", "25", "window for coalescing broadcasts", time.Millisecond, func(c *Config) *time.Duration { return &c.BroadcastDebounce }),
+	intVar("BOARD_FULL_RENDER_EVERY", "50", "board updates between full renders", func(c *Config) *int { return &c.BoardFullRenderEvery }),
+
+	stringVar("EVENT_LOG_FILE", "data/events.jsonl", "append-only log of game events", func(c *Config) *string { return &c.EventLogFile }),
+	stringVar("LEADERBOARD_FILE", "data/leaderboard.jsonl", "store of every finish", func(c *Config) *string { return &c.LeaderboardFile }),
+	stringVar("SNAPSHOT_FILE", "data/snapshot.json", "game snapshot restored on startup", func(c *Config) *string { return &c.SnapshotFile }),
+	durationVar("SNAPSHOT_INTERVAL_SECONDS", "30", "interval between snapshots, 0 only snapshots on events", time.Second, func(c *Config) *time.Duration { return &c.SnapshotInterval }),
+	durationVar("SHUTDOWN_TIMEOUT_SECONDS", "10", "wait for in-flight requests on shutdown", time.Second, func(c *Config) *time.Duration { return &c.ShutdownTimeout }),
+
+	stringVar("BROKER_HUB_ADDR", "", "broker hub to join, host:port or unix:/path", func(c *Config) *string { return &c.BrokerHubAddr }),
+	stringVar("BROKER_HUB_LISTEN", "", "run a broker hub in this process on this address", func(c *Config) *string { return &c.BrokerHubListen }),
+	stringVar("INSTANCE_ID", "", "name of this instance, defaults to hostname:PORT", func(c *Config) *string { return &c.InstanceID }),
+	stringVar("INSTANCE_URL", "", "URL other instances reach this one at, defaults to http://localhost:PORT", func(c *Config) *string { return &c.InstanceURL }),
+	secretVar("CLUSTER_SECRET", "", "secret the instances present to the broker hub and send with calls to each other", func(c *Config) *string { return &c.ClusterSecret }),
+
+	secretVar("ADMIN_TOKEN", "", "bearer token for /admin and /api/v1/admin", func(c *Config) *string { return &c.AdminToken }),
+	stringVar("ADMIN_USER", "", "basic auth user for /admin", func(c *Config) *string { return &c.AdminUser }),
+	secretVar("ADMIN_PASSWORD", "", "basic auth password for /admin", func(c *Config) *string { return &c.AdminPassword }),
+}
+
+// Flag name of a setting, e.g. BOARD_DIM -> board-dim
+func flagName(key string) string {
+	return strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+}
+
+// Registers a flag per setting and returns the values given on the command line
+func ConfigFlags(fs *flag.FlagSet) map[string]string {
+	given := map[string]string{}
+	for _, v := range configVars {
+		key := v.key
+		usage := fmt.Sprintf("%v (%v, default %q)", v.usage, key, v.def)
+		set := func(raw string) error {
+			given[key] = raw
+			return nil
+		}
+		if v.isBool {
+			fs.BoolFunc(flagName(key), usage, set)
+		} else {
+			fs.Func(flagName(key), usage, set)
+		}
+	}
+	return given
+}
+
+// Resolves every setting and validates the result
+// A missing file is fine; the Config is returned with the validation error so it can still be printed
+func LoadConfig(path string, flags map[string]string) (*Config, error) {
+	file := map[string]string{}
+	if path != "" {
+		read, err := godotenv.Read(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("reading %v: %w", path, err)
+		}
+		if read != nil {
+			file = read
+		}
+	}
+
+	cfg := &Config{sources: make(map[string]string, len(configVars))}
+	errs := []error{}
+	for _, v := range configVars {
+		raw, source := v.def, "default"
+		if val, ok := file[v.key]; ok {
+			raw, source = val, "file"
+		}
+		if val, ok := os.LookupEnv(v.key); ok {
+			raw, source = val, "env"
+		}
+		if val, ok := flags[v.key]; ok {
+			raw, source = val, "flag"
+		}
+
+		if err := v.set(cfg, raw); err != nil {
+			errs = append(errs, err)
+		}
+		cfg.sources[v.key] = source
+	}
+	if len(errs) > 0 {
+		return cfg, errors.Join(errs...)
+	}
+
+	return cfg, cfg.Validate()
+}
+
+var hexColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// Checks the settings make a playable game, reporting every problem at once
+func (cfg *Config) Validate() error {
+	errs := []error{}
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(cfg.Port > 0 && cfg.Port <= 65535, "PORT must be between 1 and 65535, got %v", cfg.Port)
+	check(cfg.GinMode == gin.DebugMode || cfg.GinMode == gin.ReleaseMode || cfg.GinMode == gin.TestMode,
+		"GIN_MODE must be debug, release or test, got %q", cfg.GinMode)
+	_, knownLevel := logLevels[cfg.LogLevel]
+	check(knownLevel, "LOG_LEVEL must be debug, info, warn or error, got %q", cfg.LogLevel)
+	check(cfg.LogFormat == "text" || cfg.LogFormat == "json", "LOG_FORMAT must be text or json, got %q", cfg.LogFormat)
+
+	check(cfg.MaxPlayers >= 1, "MAX_PLAYERS must be at least 1, got %v", cfg.MaxPlayers)
+	check(cfg.BoardDim >= 2, "BOARD_DIM must be at least 2, got %v", cfg.BoardDim)
+	check(cfg.DiceDim >= 2, "DICE_DIM must be at least 2, got %v", cfg.DiceDim)
+	check(cfg.MaxPortals >= 0, "MAX_PORTALS can't be negative, got %v", cfg.MaxPortals)
+	// Every portal takes two cells, and the first and last cells can't be used
+	if cfg.BoardDim >= 2 && cfg.MaxPortals >= 0 {
+		free := cfg.BoardDim*cfg.BoardDim - 2
+		check(2*cfg.MaxPortals <= free, "MAX_PORTALS=%v needs %v cells but a %vx%v board has %v free",
+			cfg.MaxPortals, 2*cfg.MaxPortals, cfg.BoardDim, cfg.BoardDim, free)
+	}
+	check(hexColor.MatchString(cfg.DefaultCellColor), "DEFAULT_CELL_COLOR must be a hex color like #2b89e2, got %q", cfg.DefaultCellColor)
+	check(cfg.MaxStreams >= 1, "MAX_STREAMS must be at least 1, got %v", cfg.MaxStreams)
+	check(cfg.MaxBestFinishes >= 0, "MAX_BEST_FINISHES can't be negative, got %v", cfg.MaxBestFinishes)
+	check(cfg.MaxNameLen >= 1, "MAX_NAME_LEN must be at least 1, got %v", cfg.MaxNameLen)
+
+	check(cfg.SSEReplaySize >= 0, "SSE_REPLAY_SIZE can't be negative, got %v", cfg.SSEReplaySize)
+	check(cfg.SSEMaxDrops >= 0, "SSE_MAX_DROPS can't be negative, got %v", cfg.SSEMaxDrops)
+	check(cfg.SSEHeartbeat >= 0, "SSE_HEARTBEAT_SECONDS can't be negative")
+	check(cfg.SSERetry >= 0, "SSE_RETRY_MS can't be negative")
+	check(cfg.SSEWriteTimeout >= 0, "SSE_WRITE_TIMEOUT_SECONDS can't be negative")
+	check(cfg.BroadcastDebounce >= 0, "BROADCAST_DEBOUNCE_MS can't be negative")
+	check(cfg.BoardFullRenderEvery >= 0, "BOARD_FULL_RENDER_EVERY can't be negative, got %v", cfg.BoardFullRenderEvery)
+
+	check(cfg.EventLogFile != "", "EVENT_LOG_FILE is required")
+	check(cfg.LeaderboardFile != "", "LEADERBOARD_FILE is required")
+	check(cfg.SnapshotFile != "", "SNAPSHOT_FILE is required")
+	check(cfg.SnapshotInterval >= 0, "SNAPSHOT_INTERVAL_SECONDS can't be negative")
+	check(cfg.ShutdownTimeout >= 0, "SHUTDOWN_TIMEOUT_SECONDS can't be negative")
+
+	check(cfg.BrokerHubAddr == "" || cfg.ClusterSecret != "", "CLUSTER_SECRET is required with BROKER_HUB_ADDR")
+	check(cfg.BrokerHubListen == "" || cfg.ClusterSecret != "", "CLUSTER_SECRET is required with BROKER_HUB_LISTEN")
+
+	check((cfg.AdminUser == "") == (cfg.AdminPassword == ""), "ADMIN_USER and ADMIN_PASSWORD must be set together")
+
+	return errors.Join(errs...)
+}
+
+// Writes the resolved settings as KEY=VALUE lines with their source
+func (cfg *Config) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, v := range configVars {
+		fmt.Fprintf(tw, "%v=%v\t# %v\n", v.key, v.get(cfg), cfg.sources[v.key])
+	}
+	tw.Flush()
+}
+
+// The admin area is only mounted when some credential is configured
+func (cfg *Config) AdminEnabled() bool {
+	return cfg.AdminToken != "" || cfg.AdminUser != ""
+}
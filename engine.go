@@ -0,0 +1,441 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+/* Game engine: one goroutine owns every Game mutation and processes typed commands in order */
+
+const maxChatLen = 280
+
+type JoinCmd struct {
+	PlayerID string
+	Name     string
+}
+
+type LeaveCmd struct {
+	PlayerID string
+}
+
+type RollCmd struct {
+	PlayerID string
+	// Fixed roll for tests and replays, 0 rolls the dice
+	Roll int
+}
+
+type ChatCmd struct {
+	PlayerID string
+	Text     string
+}
+
+// Starts a new round on the same board
+type StartCmd struct{}
+
+// Regenerates the board and starts a new round
+type ResetCmd struct{}
+
+// Game rules an admin can change while the server runs
+// They are logged and saved with the game, so they outlive restarts
+// The board size and portals apply from the next board reset
+type Rules struct {
+	DiceDim    int `json:"dice_dim"`
+	BoardDim   int `json:"board_dim"`
+	MaxPortals int `json:"max_portals"`
+}
+
+// Replaces the rules, refused when the config wouldn't validate with them
+type RulesCmd struct {
+	Rules Rules
+}
+
+// Admin action: applies Cmd, if any, then records who did what for the stream
+type AdminCmd struct {
+	Actor   string
+	Action  string
+	Message string
+	Cmd     any
+}
+
+// Changes state kept outside the game, such as the leaderboard store
+// Run as the Cmd of an AdminCmd, the change and its audit record happen in one
+// step: a failed change records nothing, and Apply's message is the one recorded
+type StoreCmd struct {
+	Apply func() (message string, err error)
+}
+
+// Runs a function against the game between two commands
+type execCmd struct {
+	fn func(game *Game)
+}
+
+// Applies events another instance produced, keeping this game a replica of its game
+type replicaCmd struct {
+	events []DomainEvent
+}
+
+// Outcome of a single dice roll, shared by the HTMX and JSON handlers
+type RollResult struct {
+	Roll       int    `json:"roll"`
+	Player     Player `json:"player"`
+	Moved      bool   `json:"moved"`
+	Teleported bool   `json:"teleported"`
+	Completed  bool   `json:"completed"`
+	CellValue  int    `json:"cell_value"`
+}
+
+type engineReply struct {
+	result any
+	err    error
+}
+
+type envelope struct {
+	cmd   any
+	reply chan engineReply
+}
+
+type Engine struct {
+	game  *Game
+	cfg   *Config
+	cmds  chan envelope
+	quit  chan struct{}
+	close sync.Once
+
+	mu        sync.Mutex
+	listeners []func([]DomainEvent)
+	// Configured rules, in force until an admin changes them
+	rules Rules
+	// Refuses game mutations while it returns an error, see SetGate
+	gate func() error
+}
+
+// Creates the engine and starts its goroutine
+func NewEngine(game *Game, cfg *Config) *Engine {
+	e := &Engine{
+		game: game,
+		cfg:  cfg,
+		cmds: make(chan envelope),
+		quit: make(chan struct{}),
+		rules: Rules{
+			DiceDim:    cfg.DiceDim,
+			BoardDim:   cfg.BoardDim,
+			MaxPortals: cfg.MaxPortals,
+		},
+	}
+	go e.run()
+	return e
+}
+
+// Registers a listener for the events of every processed command
+// Listeners run on the engine goroutine, in registration order, before the
+// command's caller gets its result
+func (e *Engine) Subscribe(fn func([]DomainEvent)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.listeners = append(e.listeners, fn)
+}
+
+// Installs a check run before every command that mutates the game
+// Exec and replicated events bypass it
+func (e *Engine) SetGate(gate func() error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.gate = gate
+}
+
+func (e *Engine) allowed(cmd any) error {
+	switch cmd.(type) {
+	case execCmd, replicaCmd:
+		return nil
+	}
+	e.mu.Lock()
+	gate := e.gate
+	e.mu.Unlock()
+	if gate == nil {
+		return nil
+	}
+	return gate()
+}
+
+// Stops the engine goroutine; later commands fail
+func (e *Engine) Stop() {
+	e.close.Do(func() { close(e.quit) })
+}
+
+func (e *Engine) run() {
+	for {
+		select {
+		case <-e.quit:
+			return
+		case env := <-e.cmds:
+			if err := e.allowed(env.cmd); err != nil {
+				env.reply <- engineReply{err: err}
+				continue
+			}
+			result, events, err := e.apply(env.cmd)
+			if checkErr := e.game.CheckOccupancy(); checkErr != nil {
+				slog.Error("occupancy invariant broken", "game_id", e.game.ID, "action", fmt.Sprintf("%T", env.cmd), "err", checkErr)
+			}
+			if len(events) > 0 {
+				e.mu.Lock()
+				listeners := e.listeners
+				e.mu.Unlock()
+				for _, fn := range listeners {
+					fn(events)
+				}
+			}
+			env.reply <- engineReply{result: result, err: err}
+		}
+	}
+}
+
+// Sends the command to the engine and waits for its result
+func (e *Engine) Do(cmd any) (any, error) {
+	env := envelope{cmd: cmd, reply: make(chan engineReply, 1)}
+	select {
+	case e.cmds <- env:
+	case <-e.quit:
+		return nil, fmt.Errorf("Game engine stopped")
+	}
+	reply := <-env.reply
+	return reply.result, reply.err
+}
+
+func (e *Engine) Join(playerID, name string) (Player, error) {
+	res, err := e.Do(JoinCmd{PlayerID: playerID, Name: name})
+	if err != nil {
+		return Player{}, err
+	}
+	return res.(Player), nil
+}
+
+func (e *Engine) Leave(playerID string) (Player, error) {
+	res, err := e.Do(LeaveCmd{PlayerID: playerID})
+	if err != nil {
+		return Player{}, err
+	}
+	return res.(Player), nil
+}
+
+func (e *Engine) Roll(playerID string) (RollResult, error) {
+	res, err := e.Do(RollCmd{PlayerID: playerID})
+	if err != nil {
+		return RollResult{}, err
+	}
+	return res.(RollResult), nil
+}
+
+func (e *Engine) Chat(playerID, text string) error {
+	_, err := e.Do(ChatCmd{PlayerID: playerID, Text: text})
+	return err
+}
+
+func (e *Engine) Start() error {
+	_, err := e.Do(StartCmd{})
+	return err
+}
+
+func (e *Engine) Reset() error {
+	_, err := e.Do(ResetCmd{})
+	return err
+}
+
+// The admin's rules when set, the configured ones otherwise
+func (e *Engine) Rules() Rules {
+	e.game.Mu.Lock()
+	defer e.game.Mu.Unlock()
+	if e.game.Rules != nil {
+		return *e.game.Rules
+	}
+	return e.rules
+}
+
+// Runs fn on the engine goroutine, so it sees no command half-applied
+// fn must not call back into the engine
+func (e *Engine) Exec(fn func(game *Game)) error {
+	_, err := e.Do(execCmd{fn: fn})
+	return err
+}
+
+// Applies one command to the game
+// returns the typed result, the events it produced and an error
+func (e *Engine) apply(cmd any) (any, []DomainEvent, error) {
+	switch cmd := cmd.(type) {
+	case JoinCmd:
+		return e.join(cmd)
+	case LeaveCmd:
+		return e.leave(cmd)
+	case RollCmd:
+		return e.roll(cmd)
+	case ChatCmd:
+		return e.chat(cmd)
+	case StartCmd:
+		meta := newMeta()
+		e.game.RestartRound(meta.Time)
+		return nil, []DomainEvent{GameStarted{EventMeta: meta}}, nil
+	case execCmd:
+		cmd.fn(e.game)
+		return nil, nil, nil
+	case replicaCmd:
+		// Events applied before a failing one still reach the listeners
+		for i, ev := range cmd.events {
+			if err := e.game.Apply(ev); err != nil {
+				return nil, cmd.events[:i], fmt.Errorf("replicated %v: %w", ev.EventName(), err)
+			}
+		}
+		return nil, cmd.events, nil
+	case ResetCmd:
+		meta := newMeta()
+		cfg := e.rulesConfig(e.Rules())
+		fresh := &Game{}
+		fresh.InitGame(&cfg)
+		e.game.ReplaceBoard(fresh, meta.Time)
+		return nil, []DomainEvent{BoardReset{EventMeta: meta, BoardID: fresh.BoardID, Size: fresh.Size, Board: copyBoard(fresh.Board)}}, nil
+	case RulesCmd:
+		return e.setRules(cmd.Rules)
+	case StoreCmd:
+		message, err := cmd.Apply()
+		return message, nil, err
+	case AdminCmd:
+		return e.admin(cmd)
+	default:
+		return nil, nil, fmt.Errorf("Unknown command %T", cmd)
+	}
+}
+
+func (e *Engine) join(cmd JoinCmd) (any, []DomainEvent, error) {
+	if err := e.game.AddPlayer(cmd.PlayerID, cmd.Name); err != nil {
+		return nil, nil, err
+	}
+	player, _, err := e.game.PlayerCell(cmd.PlayerID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return player, []DomainEvent{
+		PlayerJoined{EventMeta: newMeta(), PlayerID: player.ID, Name: player.Name},
+	}, nil
+}
+
+func (e *Engine) leave(cmd LeaveCmd) (any, []DomainEvent, error) {
+	player, _, err := e.game.PlayerCell(cmd.PlayerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := e.game.RemovePlayer(cmd.PlayerID); err != nil {
+		return nil, nil, err
+	}
+
+	return player, []DomainEvent{
+		PlayerLeft{EventMeta: newMeta(), PlayerID: player.ID, Name: player.Name},
+	}, nil
+}
+
+func (e *Engine) roll(cmd RollCmd) (any, []DomainEvent, error) {
+	player, from, err := e.game.PlayerCell(cmd.PlayerID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	roll := cmd.Roll
+	if roll == 0 {
+		roll = GetRandNumber(1, e.Rules().DiceDim+1)
+	}
+
+	playerState, hasTeleported, hasMoved, hasCompleted, dest, moveErr := e.game.MovePlayer(roll, cmd.PlayerID)
+	if moveErr != nil {
+		return nil, nil, moveErr
+	}
+
+	events := []DomainEvent{
+		DiceRolled{EventMeta: newMeta(), PlayerID: player.ID, Name: player.Name, Roll: roll},
+	}
+	if hasMoved {
+		landed := dest
+		if hasTeleported {
+			landed = from + roll
+		}
+		events = append(events, Moved{EventMeta: newMeta(), PlayerID: player.ID, Name: player.Name, From: from, To: landed})
+		if hasTeleported {
+			events = append(events, Teleported{EventMeta: newMeta(), PlayerID: player.ID, Name: player.Name, From: landed, To: dest})
+		}
+		if hasCompleted {
+			events = append(events, Completed{EventMeta: newMeta(), PlayerID: player.ID, Name: player.Name, Elapsed: playerState.Timer.Elasped, Rolls: playerState.Rolls})
+		}
+	}
+
+	return RollResult{
+		Roll:       roll,
+		Player:     playerState,
+		Moved:      hasMoved,
+		Teleported: hasTeleported,
+		Completed:  hasCompleted,
+		CellValue:  dest,
+	}, events, nil
+}
+
+func (e *Engine) chat(cmd ChatCmd) (any, []DomainEvent, error) {
+	text := strings.TrimSpace(cmd.Text)
+	if text == "" {
+		return nil, nil, fmt.Errorf("Message required")
+	}
+	if utf8.RuneCountInString(text) > maxChatLen {
+		return nil, nil, fmt.Errorf("Message must be at most %v characters", maxChatLen)
+	}
+
+	name, err := e.game.PlayerName(cmd.PlayerID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return nil, []DomainEvent{
+		ChatPosted{EventMeta: newMeta(), PlayerID: cmd.PlayerID, Name: name, Text: text},
+	}, nil
+}
+
+// Copy of the config with the rules in place of the configured ones
+func (e *Engine) rulesConfig(rules Rules) Config {
+	cfg := *e.cfg
+	cfg.DiceDim = rules.DiceDim
+	cfg.BoardDim = rules.BoardDim
+	cfg.MaxPortals = rules.MaxPortals
+	return cfg
+}
+
+func (e *Engine) setRules(rules Rules) (any, []DomainEvent, error) {
+	cfg := e.rulesConfig(rules)
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	changed := RulesChanged{EventMeta: newMeta(), Rules: rules}
+	if err := e.game.Apply(changed); err != nil {
+		return nil, nil, err
+	}
+	return rules, []DomainEvent{changed}, nil
+}
+
+func (e *Engine) admin(cmd AdminCmd) (any, []DomainEvent, error) {
+	var result any
+	var events []DomainEvent
+	if cmd.Cmd != nil {
+		var err error
+		if result, events, err = e.apply(cmd.Cmd); err != nil {
+			return nil, nil, err
+		}
+	}
+	message := cmd.Message
+	if _, ok := cmd.Cmd.(StoreCmd); ok {
+		message = result.(string)
+	}
+
+	return result, append(events, AdminActed{
+		EventMeta: newMeta(),
+		Actor:     cmd.Actor,
+		Action:    cmd.Action,
+		Message:   message,
+	}), nil
+}
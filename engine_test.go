@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Engine on a 3x3 board with a single portal from cell 3 to cell 7
+func newTestEngine(t *testing.T) *Engine {
+	t.Helper()
+	cfg, err := LoadConfig("", map[string]string{"BOARD_DIM": "3", "MAX_PORTALS": "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	game := &Game{}
+	game.InitGame(cfg)
+	src, dest := game.Finder[3], game.Finder[7]
+	game.Board[src.Row][src.Col].IsPortal = true
+	game.Board[src.Row][src.Col].Dest = dest
+
+	e := NewEngine(game, cfg)
+	t.Cleanup(e.Stop)
+	return e
+}
+
+// Drops what differs from run to run: times, elapsed durations and fresh boards
+func stableEvents(events []DomainEvent) []DomainEvent {
+	out := make([]DomainEvent, 0, len(events))
+	for _, ev := range events {
+		switch e := ev.(type) {
+		case PlayerJoined:
+			e.EventMeta = EventMeta{}
+			ev = e
+		case PlayerLeft:
+			e.EventMeta = EventMeta{}
+			ev = e
+		case DiceRolled:
+			e.EventMeta = EventMeta{}
+			ev = e
+		case Moved:
+			e.EventMeta = EventMeta{}
+			ev = e
+		case Teleported:
+			e.EventMeta = EventMeta{}
+			ev = e
+		case Completed:
+			e.EventMeta, e.Elapsed = EventMeta{}, 0
+			ev = e
+		case BoardReset:
+			e.EventMeta, e.BoardID, e.Board = EventMeta{}, "", nil
+			ev = e
+		case RulesChanged:
+			e.EventMeta = EventMeta{}
+			ev = e
+		case AdminActed:
+			e.EventMeta = EventMeta{}
+			ev = e
+		}
+		out = append(out, ev)
+	}
+	return out
+}
+
+func TestEngineDo(t *testing.T) {
+	join := JoinCmd{PlayerID: "p1", Name: "Bob"}
+
+	tests := []struct {
+		name  string
+		setup []any
+		cmd   any
+		want  []DomainEvent
+		err   string
+	}{
+		{
+			name: "join",
+			cmd:  join,
+			want: []DomainEvent{PlayerJoined{PlayerID: "p1", Name: "Bob"}},
+		},
+		{
+			name:  "join twice",
+			setup: []any{join},
+			cmd:   join,
+			err:   "Player already exists",
+		},
+		{
+			name:  "join with a taken name",
+			setup: []any{join},
+			cmd:   JoinCmd{PlayerID: "p2", Name: "bob"},
+			err:   "Name is already taken",
+		},
+		{
+			name:  "roll",
+			setup: []any{join},
+			cmd:   RollCmd{PlayerID: "p1", Roll: 1},
+			want: []DomainEvent{
+				DiceRolled{PlayerID: "p1", Name: "Bob", Roll: 1},
+				Moved{PlayerID: "p1", Name: "Bob", From: 1, To: 2},
+			},
+		},
+		{
+			name:  "roll onto a portal",
+			setup: []any{join},
+			cmd:   RollCmd{PlayerID: "p1", Roll: 2},
+			want: []DomainEvent{
+				DiceRolled{PlayerID: "p1", Name: "Bob", Roll: 2},
+				Moved{PlayerID: "p1", Name: "Bob", From: 1, To: 3},
+				Teleported{PlayerID: "p1", Name: "Bob", From: 3, To: 7},
+			},
+		},
+		{
+			name:  "roll onto the last cell",
+			setup: []any{join, RollCmd{PlayerID: "p1", Roll: 1}},
+			cmd:   RollCmd{PlayerID: "p1", Roll: 7},
+			want: []DomainEvent{
+				DiceRolled{PlayerID: "p1", Name: "Bob", Roll: 7},
+				Moved{PlayerID: "p1", Name: "Bob", From: 2, To: 9},
+				Completed{PlayerID: "p1", Name: "Bob", Rolls: 2},
+			},
+		},
+		{
+			name:  "roll past the last cell",
+			setup: []any{join},
+			cmd:   RollCmd{PlayerID: "p1", Roll: 9},
+			want:  []DomainEvent{DiceRolled{PlayerID: "p1", Name: "Bob", Roll: 9}},
+		},
+		{
+			name: "roll without joining",
+			cmd:  RollCmd{PlayerID: "p1", Roll: 1},
+			err:  "Player doesn't exists",
+		},
+		{
+			name:  "leave",
+			setup: []any{join},
+			cmd:   LeaveCmd{PlayerID: "p1"},
+			want:  []DomainEvent{PlayerLeft{PlayerID: "p1", Name: "Bob"}},
+		},
+		{
+			name: "leave without joining",
+			cmd:  LeaveCmd{PlayerID: "p1"},
+			err:  "Player doesn't exists",
+		},
+		{
+			name:  "reset",
+			setup: []any{join, RollCmd{PlayerID: "p1", Roll: 1}},
+			cmd:   ResetCmd{},
+			want:  []DomainEvent{BoardReset{Size: 3}},
+		},
+		{
+			name: "rules",
+			cmd:  RulesCmd{Rules: Rules{DiceDim: 4, BoardDim: 3, MaxPortals: 0}},
+			want: []DomainEvent{RulesChanged{Rules: Rules{DiceDim: 4, BoardDim: 3, MaxPortals: 0}}},
+		},
+		{
+			name: "rules that don't validate",
+			cmd:  RulesCmd{Rules: Rules{DiceDim: 4, BoardDim: 3, MaxPortals: 30}},
+			err:  "MAX_PORTALS=30 needs 60 cells but a 3x3 board has 7 free",
+		},
+		{
+			name: "admin store change",
+			cmd: AdminCmd{Actor: "root", Action: "leaderboard.clear", Cmd: StoreCmd{Apply: func() (string, error) {
+				return "root cleared the leaderboard, 2 entries removed", nil
+			}}},
+			want: []DomainEvent{AdminActed{Actor: "root", Action: "leaderboard.clear", Message: "root cleared the leaderboard, 2 entries removed"}},
+		},
+		{
+			name: "failed admin store change",
+			cmd: AdminCmd{Actor: "root", Action: "leaderboard.remove", Cmd: StoreCmd{Apply: func() (string, error) {
+				return "", fmt.Errorf("Leaderboard entry doesn't exists")
+			}}},
+			err: "Leaderboard entry doesn't exists",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEngine(t)
+			for _, cmd := range tt.setup {
+				if _, err := e.Do(cmd); err != nil {
+					t.Fatalf("setup %T: %v", cmd, err)
+				}
+			}
+
+			var got []DomainEvent
+			e.Subscribe(func(events []DomainEvent) { got = append(got, events...) })
+
+			_, err := e.Do(tt.cmd)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("Do(%T) err = %v, want %q", tt.cmd, err, tt.err)
+				}
+				if len(got) > 0 {
+					t.Fatalf("refused %T emitted %+v", tt.cmd, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Do(%T): %v", tt.cmd, err)
+			}
+			if got := stableEvents(got); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Do(%T) emitted\n%+v\nwant\n%+v", tt.cmd, got, tt.want)
+			}
+		})
+	}
+}
+
+// The reset event carries the new board, so replaying it rebuilds the same game
+func TestEngineResetEmitsBoard(t *testing.T) {
+	e := newTestEngine(t)
+	if _, err := e.Join("p1", "Bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	var reset BoardReset
+	e.Subscribe(func(events []DomainEvent) { reset = events[0].(BoardReset) })
+	if err := e.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	var board [][]Cell
+	e.Exec(func(game *Game) { board = copyBoard(game.Board) })
+	snap := e.game.Snapshot()
+	if reset.BoardID == "" || reset.BoardID != snap.BoardID {
+		t.Fatalf("reset board ID %q, game board ID %q", reset.BoardID, snap.BoardID)
+	}
+	if !reflect.DeepEqual(reset.Board, board) {
+		t.Fatal("reset event board differs from the game board")
+	}
+	if player := snap.Players["p1"]; player.Position != (Position{Row: 2, Col: 0}) || player.Rolls != 0 {
+		t.Fatalf("player not back at the start after a reset: %+v", player)
+	}
+}
+
+// Rules set by an admin come back from the snapshot and from the event log
+func TestRulesOutliveRestart(t *testing.T) {
+	e := newTestEngine(t)
+	created := e.game.Created()
+	rules := Rules{DiceDim: 4, BoardDim: 3, MaxPortals: 0}
+
+	var logged []DomainEvent
+	e.Subscribe(func(events []DomainEvent) { logged = append(logged, events...) })
+	if _, err := e.Do(RulesCmd{Rules: rules}); err != nil {
+		t.Fatal(err)
+	}
+
+	var saved SavedGameState
+	e.Exec(func(game *Game) { saved = game.Save() })
+	restored := &Game{}
+	if err := restored.Restore(saved); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := ReplayGame(append([]DomainEvent{created}, logged...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig("", map[string]string{"BOARD_DIM": "3", "MAX_PORTALS": "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, game := range map[string]*Game{"snapshot": restored, "event log": replayed} {
+		restarted := NewEngine(game, cfg)
+		if got := restarted.Rules(); got != rules {
+			t.Errorf("rules from the %v are %+v, want %+v", name, got, rules)
+		}
+		restarted.Stop()
+	}
+}
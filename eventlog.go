@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/* Event log: append-only JSON lines file of every domain event, one game after another */
+
+// One line of the event log
+type LoggedEvent struct {
+	Seq    uint64          `json:"seq"`
+	GameID string          `json:"game_id"`
+	Type   string          `json:"type"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type EventLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	seq  uint64
+	// Game ID -> sequence number of its last entry
+	games map[string]uint64
+}
+
+// Opens the log file named by EVENT_LOG_FILE, creating it when missing
+func NewEventLog(path string) *EventLog {
+	eventLog, err := OpenEventLog(path)
+	if err != nil {
+		fatal("error while opening EVENT_LOG_FILE", "path", path, "err", err)
+	}
+	return eventLog
+}
+
+func OpenEventLog(path string) (*EventLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	// Continuing the sequence of the existing entries
+	existing, err := ReadEventLog(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Appending after a torn line would glue the next entry to it
+	if err == nil {
+		size, lines, err := completeLines(path)
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && info.Size() > size {
+			slog.Warn("cutting torn tail off the event log", "path", path, "size", info.Size(), "kept", size)
+			if err := os.Truncate(path, size); err != nil {
+				return nil, err
+			}
+		}
+		existing = existing[:lines]
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	eventLog := &EventLog{path: path, file: file, games: map[string]uint64{}}
+	for _, entry := range existing {
+		eventLog.seq = entry.Seq
+		eventLog.games[entry.GameID] = entry.Seq
+	}
+	return eventLog, nil
+}
+
+func (l *EventLog) Path() string {
+	return l.path
+}
+
+// Sequence number of the last appended entry
+func (l *EventLog) Seq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// Sequence number of the game's last entry, 0 when it has none
+func (l *EventLog) GameSeq(gameID string) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.games[gameID]
+}
+
+// Appends the events of one command and syncs the file
+// The events go out in a single write, but a crash can still tear it: the lines
+// before the torn one stay logged and OpenEventLog cuts the rest off
+func (l *EventLog) Append(gameID string, events ...DomainEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var buf []byte
+	seq := l.seq
+	for _, ev := range events {
+		seq++
+		entry, err := newLoggedEvent(seq, gameID, ev)
+		if err != nil {
+			return err
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	if _, err := l.file.Write(buf); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.seq = seq
+	if len(events) > 0 {
+		l.games[gameID] = seq
+	}
+	return nil
+}
+
+func (l *EventLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Reads every entry of the log file in order
+// A torn last line, left by a crash mid-write, is skipped
+func ReadEventLog(path string) ([]LoggedEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []LoggedEvent{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	var torn error
+	for scanner.Scan() {
+		line++
+		if torn != nil {
+			return nil, torn
+		}
+
+		var entry LoggedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			torn = fmt.Errorf("event log %v line %v: %v", path, line, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if torn != nil {
+		slog.Warn("skipping torn last entry", "err", torn)
+	}
+
+	return entries, scanner.Err()
+}
+
+// Size and number of the lines up to the last complete one, ended by a newline
+// Only called once ReadEventLog succeeded, so nothing but the tail can be torn
+func completeLines(path string) (int64, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var size int64
+	lines := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return size, lines, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if !json.Valid(line) {
+			return size, lines, nil
+		}
+		size += int64(len(line))
+		lines++
+	}
+}
+
+func newLoggedEvent(seq uint64, gameID string, ev DomainEvent) (LoggedEvent, error) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return LoggedEvent{}, err
+	}
+	return LoggedEvent{Seq: seq, GameID: gameID, Type: ev.EventName(), Data: data}, nil
+}
+
+// Decodes the entry back into its typed domain event
+func (e LoggedEvent) Event() (DomainEvent, error) {
+	decode, ok := eventDecoders[e.Type]
+	if !ok {
+		return nil, fmt.Errorf("Unknown event type %q", e.Type)
+	}
+	return decode(e.Data)
+}
+
+var eventDecoders = map[string]func([]byte) (DomainEvent, error){
+	"GameCreated":  decodeEvent[GameCreated],
+	"PlayerJoined": decodeEvent[PlayerJoined],
+	"PlayerLeft":   decodeEvent[PlayerLeft],
+	"DiceRolled":   decodeEvent[DiceRolled],
+	"Moved":        decodeEvent[Moved],
+	"Teleported":   decodeEvent[Teleported],
+	"Completed":    decodeEvent[Completed],
+	"ChatPosted":   decodeEvent[ChatPosted],
+	"GameStarted":  decodeEvent[GameStarted],
+	"BoardReset":   decodeEvent[BoardReset],
+	"RulesChanged": decodeEvent[RulesChanged],
+	"AdminActed":   decodeEvent[AdminActed],
+}
+
+func decodeEvent[T DomainEvent](data []byte) (DomainEvent, error) {
+	var ev T
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// Returns the decoded events of the given game, in log order
+func GameEvents(entries []LoggedEvent, gameID string) ([]DomainEvent, error) {
+	events := []DomainEvent{}
+	for _, entry := range entries {
+		if entry.GameID != gameID {
+			continue
+		}
+		ev, err := entry.Event()
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
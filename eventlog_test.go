@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A crash mid-write leaves a torn line, the next append must not be glued to it
+func TestEventLogCutsTornTail(t *testing.T) {
+	tests := []struct {
+		name string
+		torn string
+	}{
+		{name: "partial line", torn: `{"seq":3,"game_id":"g","ty`},
+		{name: "line without its newline", torn: `{"seq":3,"game_id":"g","type":"PlayerLeft","data":{}}`},
+		{name: "nothing torn", torn: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "events.jsonl")
+			eventLog, err := OpenEventLog(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := eventLog.Append("g", PlayerJoined{PlayerID: "p1", Name: "Bob"}, PlayerJoined{PlayerID: "p2", Name: "Ann"}); err != nil {
+				t.Fatal(err)
+			}
+			eventLog.Close()
+
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString(tt.torn)
+			f.Close()
+
+			eventLog, err = OpenEventLog(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := eventLog.Append("g", PlayerLeft{PlayerID: "p1", Name: "Bob"}); err != nil {
+				t.Fatal(err)
+			}
+			eventLog.Close()
+
+			entries, err := ReadEventLog(path)
+			if err != nil {
+				t.Fatalf("log unreadable after the append: %v", err)
+			}
+			var types []string
+			for i, entry := range entries {
+				if entry.Seq != uint64(i+1) {
+					t.Fatalf("entry %v has seq %v", i, entry.Seq)
+				}
+				types = append(types, entry.Type)
+			}
+			if len(types) != 3 || types[2] != "PlayerLeft" {
+				t.Fatalf("log has %v, want both joins and the leave", types)
+			}
+		})
+	}
+}
+
+// Events that couldn't be logged would be lost on restart, so no command follows them
+func TestAppendFailureStopsCommands(t *testing.T) {
+	router, h := newTestHandler(t, nil)
+	// Opened read-only, the log file refuses every write
+	file := h.Log.file
+	readOnly, err := os.Open(h.Log.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Log.file = readOnly
+	t.Cleanup(func() {
+		readOnly.Close()
+		h.Log.file = file
+	})
+
+	// Its events are applied before the append fails
+	if _, err := h.join(t.Context(), "p1", "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.roll(t.Context(), "p1"); !errors.Is(err, errLogFailed) {
+		t.Fatalf("roll after a failed append: %v, want %v", err, errLogFailed)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz answered %v after a failed append", w.Code)
+	}
+}
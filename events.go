@@ -0,0 +1,122 @@
+package main
+
+import "time"
+
+/* Domain events emitted by the Engine, one slice per processed command */
+
+type DomainEvent interface {
+	EventName() string
+	At() time.Time
+}
+
+type EventMeta struct {
+	Time time.Time `json:"time"`
+}
+
+func (m EventMeta) At() time.Time {
+	return m.Time
+}
+
+func newMeta() EventMeta {
+	return EventMeta{Time: time.Now().UTC()}
+}
+
+type PlayerJoined struct {
+	EventMeta
+	PlayerID string `json:"player_id"`
+	Name     string `json:"name"`
+}
+
+type PlayerLeft struct {
+	EventMeta
+	PlayerID string `json:"player_id"`
+	Name     string `json:"name"`
+}
+
+type DiceRolled struct {
+	EventMeta
+	PlayerID string `json:"player_id"`
+	Name     string `json:"name"`
+	Roll     int    `json:"roll"`
+}
+
+// From and To are cell values
+type Moved struct {
+	EventMeta
+	PlayerID string `json:"player_id"`
+	Name     string `json:"name"`
+	From     int    `json:"from"`
+	To       int    `json:"to"`
+}
+
+// Follows a Moved that landed on a portal; From is the portal cell
+type Teleported struct {
+	EventMeta
+	PlayerID string `json:"player_id"`
+	Name     string `json:"name"`
+	From     int    `json:"from"`
+	To       int    `json:"to"`
+}
+
+type Completed struct {
+	EventMeta
+	PlayerID string        `json:"player_id"`
+	Name     string        `json:"name"`
+	Elapsed  time.Duration `json:"elapsed"`
+	Rolls    int           `json:"rolls"`
+}
+
+type ChatPosted struct {
+	EventMeta
+	PlayerID string `json:"player_id"`
+	Name     string `json:"name"`
+	Text     string `json:"text"`
+}
+
+// First event of every game, carries the generated board
+type GameCreated struct {
+	EventMeta
+	GameID          string   `json:"game_id"`
+	Size            int      `json:"size"`
+	Board           [][]Cell `json:"board"`
+	MaxBestFinishes int      `json:"max_best_finishes"`
+}
+
+type GameStarted struct {
+	EventMeta
+}
+
+// Carries the regenerated board
+type BoardReset struct {
+	EventMeta
+	BoardID string   `json:"board_id"`
+	Size    int      `json:"size"`
+	Board   [][]Cell `json:"board"`
+}
+
+// Rules set by an admin, in force until the next change
+type RulesChanged struct {
+	EventMeta
+	Rules Rules `json:"rules"`
+}
+
+// Audit record of an admin action, follows the events the action caused
+type AdminActed struct {
+	EventMeta
+	Actor   string `json:"actor"`
+	Action  string `json:"action"`
+	Message string `json:"message"`
+}
+
+func (GameCreated) EventName() string  { return "GameCreated" }
+func (PlayerJoined) EventName() string { return "PlayerJoined" }
+func (PlayerLeft) EventName() string   { return "PlayerLeft" }
+func (DiceRolled) EventName() string   { return "DiceRolled" }
+func (Moved) EventName() string        { return "Moved" }
+func (Teleported) EventName() string   { return "Teleported" }
+func (Completed) EventName() string    { return "Completed" }
+func (ChatPosted) EventName() string   { return "ChatPosted" }
+func (GameStarted) EventName() string  { return "GameStarted" }
+func (BoardReset) EventName() string   { return "BoardReset" }
+func (RulesChanged) EventName() string { return "RulesChanged" }
+func (AdminActed) EventName() string   { return "AdminActed" }
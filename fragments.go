@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SSE topics, in the order the initial snapshot sends them
+// Each topic is the event name and is backed by one template fragment
+var Topics = []string{"board", "players", "dice", "tokens", "stream", "leaderboard"}
+
+var topicTemplates = map[string]string{
+	"board":       "_board.html",
+	"players":     "_players.html",
+	"dice":        "_dice.html",
+	"tokens":      "_tokens.html",
+	"stream":      "_stream_chats.html",
+	"leaderboard": "_leaderboard.html",
+}
+
+// Events that are delivered under another topic
+var eventTopics = map[string]string{
+	"board-delta": "board",
+}
+
+// Topic an event belongs to, events outside Topics map to themselves
+func topicOf(event string) string {
+	if topic, ok := eventTopics[event]; ok {
+		return topic
+	}
+	return event
+}
+
+// Parses a comma separated topic list, e.g. "leaderboard,stream"
+// An empty list means every topic
+func ParseTopics(raw string) ([]string, error) {
+	topics := []string{}
+	seen := map[string]bool{}
+	for _, topic := range strings.Split(raw, ",") {
+		topic = strings.TrimSpace(topic)
+		if topic == "" || seen[topic] {
+			continue
+		}
+		if _, ok := topicTemplates[topic]; !ok {
+			return nil, fmt.Errorf("Unknown topic %q", topic)
+		}
+		seen[topic] = true
+		topics = append(topics, topic)
+	}
+	return topics, nil
+}
+
+// Renders the fragment backing the topic for the given viewer from the snapshot
+func (h *GameHandler) renderTopic(snap *GameSnapshot, topic, me string) string {
+	data := gin.H{"Game": snap, "Me": me}
+	switch topic {
+	case "stream":
+		data = gin.H{"Stream": h.Stream.GetLogs()}
+	case "leaderboard":
+		data = gin.H{"Leaderboard": h.Leaderboard.Top()}
+	case "players":
+		data["Stats"] = h.playersStats(snap)
+	}
+	return h.Render(topicTemplates[topic], data)
+}
+
+// Returns a renderer for dirty topics bound to one snapshot, so every fragment
+// of a batch shows the same game state; the board may go out as a delta
+func (h *GameHandler) topicUpdateRenderer() func(topic, me string) Message {
+	snap := h.Game.Snapshot()
+	return func(topic, me string) Message {
+		if topic == "board" {
+			return h.renderBoardUpdate(snap)
+		}
+		return Message{Event: topic, Data: h.renderTopic(snap, topic, me)}
+	}
+}
+
+// Full render of the subscribed topics, sent to a client when it connects
+// A follower instance asks the owner, which holds the game state
+func (h *GameHandler) initialEvents(playerID string, topics []string) []Message {
+	if _, ok := h.Cluster.Follower(); ok {
+		msgs, err := h.Cluster.Fragments(playerID, topics)
+		if err == nil {
+			return msgs
+		}
+		slog.Error("error while fetching fragments from owner", "action", "fragments", "player_id", playerID, "err", err)
+	}
+	return h.renderInitialEvents(playerID, topics)
+}
+
+// Full render of the subscribed topics from this instance's game
+func (h *GameHandler) renderInitialEvents(playerID string, topics []string) []Message {
+	wanted := map[string]bool{}
+	for _, topic := range topics {
+		wanted[topic] = true
+	}
+
+	snap := h.Game.Snapshot()
+	msgs := []Message{}
+	for _, topic := range Topics {
+		if len(wanted) > 0 && !wanted[topic] {
+			continue
+		}
+		msgs = append(msgs, Message{Event: topic, Data: h.renderTopic(snap, topic, playerID)})
+	}
+	return msgs
+}
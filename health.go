@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* Health checks: liveness of the process and readiness to take players */
+
+// Longest the game engine may take to answer a readiness probe
+const readyTimeout = 2 * time.Second
+
+// Always ok while the process serves requests
+func (h *GameHandler) Healthz(c *gin.Context) {
+	c.String(http.StatusOK, "ok")
+}
+
+// Ok while the server isn't draining, logs events and the game engine processes commands
+func (h *GameHandler) Readyz(c *gin.Context) {
+	if h.Draining() {
+		c.String(http.StatusServiceUnavailable, "draining")
+		return
+	}
+	if h.logFailed.Load() {
+		c.String(http.StatusServiceUnavailable, errLogFailed.Error())
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Engine.Exec(func(*Game) {})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			c.String(http.StatusServiceUnavailable, err.Error())
+			return
+		}
+	case <-time.After(readyTimeout):
+		c.String(http.StatusServiceUnavailable, "game engine is not responding")
+		return
+	}
+
+	c.String(http.StatusOK, "ok")
+}
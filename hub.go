@@ -0,0 +1,513 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Broker hub: relays broadcasts between instances and decides which one owns the game */
+
+// The only room for now; every instance serves the same Game
+const defaultRoom = "main"
+
+// How long the hub collects claims for an ownerless room before granting it,
+// so the instance with the most events wins rather than the quickest one
+const hubClaimWindow = 2 * time.Second
+
+// Frame exchanged between an instance and the hub, one JSON object per line
+type hubFrame struct {
+	// hello, publish, presence, claim, owner or events
+	Type      string    `json:"type"`
+	Origin    string    `json:"origin,omitempty"`
+	Messages  []Message `json:"messages,omitempty"`
+	PlayerIDs []string  `json:"player_ids,omitempty"`
+	Room      string    `json:"room,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	// Events of the game applied by the sender, with claims and events
+	Version uint64 `json:"version,omitempty"`
+	// The owner's domain events, replicated to the followers
+	GameID string        `json:"game_id,omitempty"`
+	Events []LoggedEvent `json:"events,omitempty"`
+	// CLUSTER_SECRET, sent with hello only
+	Secret string `json:"secret,omitempty"`
+}
+
+// Splits "unix:/path/sock", "tcp:host:port" or "host:port" into net.Listen/Dial arguments
+func hubNetwork(addr string) (string, string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	if hostPort, ok := strings.CutPrefix(addr, "tcp:"); ok {
+		return "tcp", hostPort
+	}
+	return "tcp", addr
+}
+
+type hubConn struct {
+	conn     net.Conn
+	out      chan hubFrame
+	instance string
+	presence []string
+}
+
+type Hub struct {
+	// Instances must present it in their hello
+	secret string
+
+	mu    sync.Mutex
+	conns map[*hubConn]struct{}
+	// Room -> owning connection and its advertised URL
+	owners map[string]*hubConn
+	urls   map[string]string
+	// Room -> highest version seen, from the owner's events and granted claims
+	latest map[string]uint64
+	// Room -> claims collected while it has no owner
+	claims      map[string]map[*hubConn]hubFrame
+	claimWindow time.Duration
+}
+
+func NewHub(secret string) *Hub {
+	return &Hub{
+		secret:      secret,
+		conns:       map[*hubConn]struct{}{},
+		owners:      map[string]*hubConn{},
+		urls:        map[string]string{},
+		latest:      map[string]uint64{},
+		claims:      map[string]map[*hubConn]hubFrame{},
+		claimWindow: hubClaimWindow,
+	}
+}
+
+// Accepts instance connections until the listener fails
+func (hub *Hub) ListenAndServe(addr string) error {
+	network, address := hubNetwork(addr)
+	if network == "unix" {
+		// A stale socket from a previous run would make Listen fail
+		_ = os.Remove(address)
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	slog.Info("broker hub listening", "action", "hub", "addr", addr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go hub.serve(conn)
+	}
+}
+
+func (hub *Hub) serve(conn net.Conn) {
+	// Nothing is relayed to or from a connection before it proves it knows the secret
+	dec := json.NewDecoder(conn)
+	var hello hubFrame
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if err := dec.Decode(&hello); err != nil || hello.Type != "hello" || !secretEqual(hello.Secret, hub.secret) {
+		slog.Warn("broker hub refused an instance", "action", "hub", "remote", conn.RemoteAddr().String(), "type", hello.Type, "err", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	c := &hubConn{conn: conn, out: make(chan hubFrame, 64)}
+	hub.mu.Lock()
+	hub.conns[c] = struct{}{}
+	hub.mu.Unlock()
+
+	go func() {
+		enc := json.NewEncoder(conn)
+		for frame := range c.out {
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := enc.Encode(frame); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	hub.handle(c, hello)
+	for {
+		var frame hubFrame
+		if err := dec.Decode(&frame); err != nil {
+			break
+		}
+		hub.handle(c, frame)
+	}
+
+	hub.drop(c)
+}
+
+// Queues a frame for the connection, a connection that can't keep up is closed
+func (hub *Hub) send(c *hubConn, frame hubFrame) {
+	select {
+	case c.out <- frame:
+	default:
+		slog.Warn("broker hub dropping slow instance", "action", "hub", "instance", c.instance)
+		c.conn.Close()
+	}
+}
+
+func (hub *Hub) relay(from *hubConn, frame hubFrame) {
+	for c := range hub.conns {
+		if c != from {
+			hub.send(c, frame)
+		}
+	}
+}
+
+func (hub *Hub) ownerFrame(room string) hubFrame {
+	frame := hubFrame{Type: "owner", Room: room}
+	if owner, ok := hub.owners[room]; ok {
+		frame.Origin = owner.instance
+		frame.URL = hub.urls[room]
+	}
+	return frame
+}
+
+func (hub *Hub) handle(c *hubConn, frame hubFrame) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	switch frame.Type {
+	case "hello":
+		if c.instance != "" {
+			// Only the first hello, checked in serve, names the instance
+			return
+		}
+		c.instance = frame.Origin
+		// Catching the new instance up on owners and who is connected where
+		for room := range hub.owners {
+			hub.send(c, hub.ownerFrame(room))
+		}
+		for other := range hub.conns {
+			if other != c && other.instance != "" {
+				hub.send(c, hubFrame{Type: "presence", Origin: other.instance, PlayerIDs: other.presence})
+			}
+		}
+	case "publish":
+		frame.Origin = c.instance
+		hub.relay(c, frame)
+	case "presence":
+		frame.Origin = c.instance
+		c.presence = frame.PlayerIDs
+		hub.relay(c, frame)
+	case "claim":
+		// The owner keeps the room until it disconnects
+		if _, taken := hub.owners[frame.Room]; taken {
+			hub.send(c, hub.ownerFrame(frame.Room))
+			return
+		}
+		if hub.claims[frame.Room] == nil {
+			hub.claims[frame.Room] = map[*hubConn]hubFrame{}
+			room := frame.Room
+			time.AfterFunc(hub.claimWindow, func() {
+				hub.mu.Lock()
+				defer hub.mu.Unlock()
+				hub.grant(room)
+			})
+		}
+		hub.claims[frame.Room][c] = frame
+	case "events":
+		// Only the owner's events count, a former owner may still be sending
+		if hub.owners[frame.Room] != c {
+			slog.Warn("broker hub dropping events from an instance that doesn't own the room", "action", "hub", "room", frame.Room, "instance", c.instance)
+			return
+		}
+		hub.latest[frame.Room] = max(hub.latest[frame.Room], frame.Version)
+		frame.Origin = c.instance
+		hub.relay(c, frame)
+	default:
+		slog.Warn("broker hub got an unknown frame", "action", "hub", "type", frame.Type, "instance", c.instance)
+	}
+}
+
+// Gives the room to the claimer with the most events
+// A claimer behind the latest version seen would lose events, it only wins when
+// nobody is up to date, so the game goes on rather than staying frozen
+func (hub *Hub) grant(room string) {
+	claims := hub.claims[room]
+	delete(hub.claims, room)
+	if _, taken := hub.owners[room]; taken || len(claims) == 0 {
+		return
+	}
+
+	var owner *hubConn
+	var best hubFrame
+	for c, claim := range claims {
+		if owner == nil || claim.Version > best.Version {
+			owner, best = c, claim
+		}
+	}
+	if best.Version < hub.latest[room] {
+		slog.Warn("broker hub granting a room to an instance that is behind", "action", "claim", "room", room, "instance", owner.instance, "version", best.Version, "latest", hub.latest[room])
+	}
+
+	hub.owners[room] = owner
+	hub.urls[room] = best.URL
+	hub.latest[room] = max(hub.latest[room], best.Version)
+	slog.Info("broker hub room claimed", "action", "claim", "room", room, "instance", owner.instance, "url", best.URL, "version", best.Version)
+	for other := range hub.conns {
+		hub.send(other, hub.ownerFrame(room))
+	}
+}
+
+func (hub *Hub) drop(c *hubConn) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	delete(hub.conns, c)
+	close(c.out)
+	c.conn.Close()
+
+	// Its subscribers are gone, and so is its claim on any room
+	hub.relay(c, hubFrame{Type: "presence", Origin: c.instance})
+	for _, claims := range hub.claims {
+		delete(claims, c)
+	}
+	for room, owner := range hub.owners {
+		if owner == c {
+			delete(hub.owners, room)
+			delete(hub.urls, room)
+			slog.Info("broker hub room lost its owner", "action", "claim", "room", room, "instance", c.instance)
+			hub.relay(c, hub.ownerFrame(room))
+		}
+	}
+}
+
+// Broker that serves local subscribers and relays every broadcast through the hub
+// Events published by other instances are delivered to the local subscribers
+type HubBroker struct {
+	*LocalBroker
+
+	addr    string
+	cluster *Cluster
+	out     chan hubFrame
+
+	mu sync.Mutex
+	// Instance -> player IDs subscribed there
+	remote map[string][]string
+}
+
+func NewHubBroker(addr string, cluster *Cluster, cfg *Config) *HubBroker {
+	b := &HubBroker{
+		LocalBroker: NewLocalBroker(cfg),
+		addr:        addr,
+		cluster:     cluster,
+		out:         make(chan hubFrame, 256),
+		remote:      map[string][]string{},
+	}
+	cluster.mu.Lock()
+	cluster.send = b.enqueue
+	cluster.mu.Unlock()
+	go b.connectLoop()
+	return b
+}
+
+// Keeps a connection to the hub, reconnecting with a small backoff
+func (b *HubBroker) connectLoop() {
+	network, address := hubNetwork(b.addr)
+	backoff := time.Second
+	for {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			slog.Warn("error while connecting to broker hub", "action", "hub", "addr", b.addr, "err", err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, 30*time.Second)
+			continue
+		}
+		backoff = time.Second
+		slog.Info("connected to broker hub", "action", "hub", "addr", b.addr, "instance", b.cluster.Instance)
+
+		b.session(conn)
+
+		// Without the hub another instance may take over, so this one stops
+		// mutating the game until the hub names the owner again
+		b.cluster.SetOwner("", "")
+		b.mu.Lock()
+		b.remote = map[string][]string{}
+		b.mu.Unlock()
+	}
+}
+
+func (b *HubBroker) session(conn net.Conn) {
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+
+	enc := json.NewEncoder(conn)
+	write := func(frame hubFrame) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return enc.Encode(frame)
+	}
+
+	hello := []hubFrame{
+		{Type: "hello", Origin: b.cluster.Instance, Secret: b.cluster.secret},
+		{Type: "presence", PlayerIDs: b.LocalBroker.PlayerIDs("")},
+		{Type: "claim", Room: defaultRoom, URL: b.cluster.URL, Version: b.cluster.Version()},
+	}
+	for _, frame := range hello {
+		if err := write(frame); err != nil {
+			return
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case frame := <-b.out:
+				if err := write(frame); err != nil {
+					slog.Warn("error while writing to broker hub", "action", "hub", "err", err)
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	dec := json.NewDecoder(conn)
+	for {
+		var frame hubFrame
+		if err := dec.Decode(&frame); err != nil {
+			slog.Warn("lost broker hub connection", "action", "hub", "err", err)
+			return
+		}
+		b.handle(frame)
+	}
+}
+
+func (b *HubBroker) handle(frame hubFrame) {
+	switch frame.Type {
+	case "publish":
+		b.LocalBroker.BroadcastBatch(localCopy(frame.Messages))
+	case "presence":
+		b.mu.Lock()
+		if len(frame.PlayerIDs) == 0 {
+			delete(b.remote, frame.Origin)
+		} else {
+			b.remote[frame.Origin] = frame.PlayerIDs
+		}
+		b.mu.Unlock()
+	case "owner":
+		if frame.Room != defaultRoom {
+			return
+		}
+		b.cluster.SetOwner(frame.Origin, frame.URL)
+		if frame.Origin == "" {
+			// The owner went away; the claimer with the most events takes over
+			b.enqueue(hubFrame{Type: "claim", Room: defaultRoom, URL: b.cluster.URL, Version: b.cluster.Version()})
+		}
+	case "events":
+		if frame.Room == defaultRoom {
+			b.cluster.receive(frame)
+		}
+	}
+}
+
+func (b *HubBroker) enqueue(frame hubFrame) {
+	select {
+	case b.out <- frame:
+	default:
+		slog.Warn("broker hub queue full, dropping frame", "action", "hub", "type", frame.Type)
+	}
+}
+
+// Messages without local IDs, ready to be numbered by the receiving broker
+func localCopy(msgs []Message) []Message {
+	out := make([]Message, len(msgs))
+	copy(out, msgs)
+	for i := range out {
+		out[i].ID = 0
+	}
+	return out
+}
+
+func (b *HubBroker) announcePresence() {
+	b.enqueue(hubFrame{Type: "presence", PlayerIDs: b.LocalBroker.PlayerIDs("")})
+}
+
+func (b *HubBroker) Add(c chan Message, playerID string, topics []string) {
+	b.LocalBroker.Add(c, playerID, topics)
+	b.announcePresence()
+}
+
+func (b *HubBroker) Subscribe(c chan Message, playerID string, topics []string, lastEventID string) ([]Message, uint64, bool) {
+	missed, lastID, resumed := b.LocalBroker.Subscribe(c, playerID, topics, lastEventID)
+	b.announcePresence()
+	return missed, lastID, resumed
+}
+
+func (b *HubBroker) Remove(c chan Message) {
+	b.LocalBroker.Remove(c)
+	b.announcePresence()
+}
+
+func (b *HubBroker) Evict(c chan Message, reason error) {
+	b.LocalBroker.Evict(c, reason)
+	b.announcePresence()
+}
+
+// Local and remote viewers; remote topic filters aren't known so every remote
+// player counts
+func (b *HubBroker) PlayerIDs(event string) []string {
+	ids := b.LocalBroker.PlayerIDs(event)
+	seen := map[string]bool{}
+	for _, id := range ids {
+		seen[id] = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, remote := range b.remote {
+		for _, id := range remote {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+func (b *HubBroker) Wants(event string) bool {
+	if b.LocalBroker.Wants(event) {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.remote) > 0
+}
+
+func (b *HubBroker) Broadcast(event, html string) {
+	b.BroadcastBatch([]Message{{Event: event, Data: html}})
+}
+
+func (b *HubBroker) BroadcastBatch(msgs []Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	b.enqueue(hubFrame{Type: "publish", Messages: localCopy(msgs)})
+	b.LocalBroker.BroadcastBatch(msgs)
+}
+
+func (b *HubBroker) SendTo(playerID, event, html string) {
+	b.BroadcastBatch([]Message{{Event: event, Data: html, Targeted: true, To: playerID}})
+}
+
+func (b *HubBroker) BroadcastEach(event string, render func(playerID string) string) {
+	msgs := []Message{}
+	for _, playerID := range b.PlayerIDs(event) {
+		msgs = append(msgs, Message{Event: event, Data: render(playerID), Targeted: true, To: playerID})
+	}
+	b.BroadcastBatch(msgs)
+}
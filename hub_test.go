@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// Connects a fake instance to the hub and sends its first frame
+func dialHub(t *testing.T, hub *Hub, first hubFrame) (*json.Encoder, *json.Decoder) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go hub.serve(server)
+
+	enc, dec := json.NewEncoder(client), json.NewDecoder(client)
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := enc.Encode(first); err != nil {
+		t.Fatal(err)
+	}
+	return enc, dec
+}
+
+func nextFrame(t *testing.T, dec *json.Decoder) hubFrame {
+	t.Helper()
+	var frame hubFrame
+	if err := dec.Decode(&frame); err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// Claims the room and waits for the answer, so every earlier frame has been handled
+func claimRoom(t *testing.T, enc *json.Encoder, dec *json.Decoder) hubFrame {
+	t.Helper()
+	if err := enc.Encode(hubFrame{Type: "claim", Room: defaultRoom, URL: "http://owner"}); err != nil {
+		t.Fatal(err)
+	}
+	return nextFrame(t, dec)
+}
+
+func TestHubRequiresSecret(t *testing.T) {
+	hub := NewHub("s3cret")
+	hub.claimWindow = 0
+
+	enc, member := dialHub(t, hub, hubFrame{Type: "hello", Origin: "a", Secret: "s3cret"})
+	if owner := claimRoom(t, enc, member); owner.Type != "owner" || owner.Origin != "a" {
+		t.Fatalf("member got %+v, want to own the room", owner)
+	}
+
+	tests := []struct {
+		name  string
+		first hubFrame
+	}{
+		{name: "no secret", first: hubFrame{Type: "hello", Origin: "x"}},
+		{name: "wrong secret", first: hubFrame{Type: "hello", Origin: "x", Secret: "guess"}},
+		{name: "publish before hello", first: hubFrame{Type: "publish", Messages: []Message{{Event: "stream", Data: "spoofed"}}}},
+		{name: "claim before hello", first: hubFrame{Type: "claim", Room: defaultRoom, URL: "http://evil"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, dec := dialHub(t, hub, tt.first)
+			var frame hubFrame
+			if err := dec.Decode(&frame); err == nil {
+				t.Fatalf("refused instance got a frame: %+v", frame)
+			}
+		})
+	}
+
+	// The member only ever hears from the other instance that got in
+	enc, dec := dialHub(t, hub, hubFrame{Type: "hello", Origin: "b", Secret: "s3cret"})
+	// The room's owner comes back once the hello is handled
+	if frame := nextFrame(t, dec); frame.Type != "owner" || frame.Origin != "a" {
+		t.Fatalf("second instance got %+v, want the room owner", frame)
+	}
+	if err := enc.Encode(hubFrame{Type: "publish", Messages: []Message{{Event: "stream", Data: "real"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if frame := nextFrame(t, member); frame.Type != "publish" || frame.Origin != "b" || frame.Messages[0].Data != "real" {
+		t.Fatalf("member got %+v, want b's publish", frame)
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if len(hub.conns) != 2 || hub.owners[defaultRoom].instance != "a" {
+		t.Fatalf("hub has %v connections and room owner %v, want 2 and a", len(hub.conns), hub.owners[defaultRoom].instance)
+	}
+}
+
+// Skips frames of other types, as the presence every hello brings along
+func nextOfType(t *testing.T, dec *json.Decoder, typ string) hubFrame {
+	t.Helper()
+	for {
+		if frame := nextFrame(t, dec); frame.Type == typ {
+			return frame
+		}
+	}
+}
+
+// The claimer with the most events gets the room, and only its events are relayed
+func TestHubGrantsMostEvents(t *testing.T) {
+	hub := NewHub("s3cret")
+	hub.claimWindow = 100 * time.Millisecond
+
+	encA, decA := dialHub(t, hub, hubFrame{Type: "hello", Origin: "a", Secret: "s3cret"})
+	encB, decB := dialHub(t, hub, hubFrame{Type: "hello", Origin: "b", Secret: "s3cret"})
+	// The quicker claim is behind
+	if err := encA.Encode(hubFrame{Type: "claim", Room: defaultRoom, URL: "http://a", Version: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := encB.Encode(hubFrame{Type: "claim", Room: defaultRoom, URL: "http://b", Version: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, dec := range map[string]*json.Decoder{"a": decA, "b": decB} {
+		if owner := nextOfType(t, dec, "owner"); owner.Origin != "b" || owner.URL != "http://b" {
+			t.Fatalf("%v got %+v, want b to own the room", name, owner)
+		}
+	}
+
+	stale := hubFrame{Type: "events", Room: defaultRoom, GameID: "g", Version: 4, Events: []LoggedEvent{{GameID: "g", Type: "PlayerLeft"}}}
+	if err := encA.Encode(stale); err != nil {
+		t.Fatal(err)
+	}
+	events := hubFrame{Type: "events", Room: defaultRoom, GameID: "g", Version: 6, Events: []LoggedEvent{{GameID: "g", Type: "PlayerJoined"}}}
+	if err := encB.Encode(events); err != nil {
+		t.Fatal(err)
+	}
+	if frame := nextOfType(t, decA, "events"); frame.Origin != "b" || frame.Version != 6 {
+		t.Fatalf("a got %+v, want b's events", frame)
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.latest[defaultRoom] != 6 {
+		t.Fatalf("hub latest version %v, want 6", hub.latest[defaultRoom])
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+/* Leaderboard: every finish appended to a JSON lines file, the fastest kept in memory */
+
+type Leaderboard struct {
+	mu    sync.Mutex
+	file  *os.File
+	limit int
+	// Fastest finishes first, at most limit entries
+	top []BestFinish
+}
+
+// Opens the store named by LEADERBOARD_FILE and loads the fastest finishes
+func NewLeaderboard(path string, limit int) *Leaderboard {
+	board, err := OpenLeaderboard(path, limit)
+	if err != nil {
+		fatal("error while opening LEADERBOARD_FILE", "path", path, "err", err)
+	}
+	return board
+}
+
+func OpenLeaderboard(path string, limit int) (*Leaderboard, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	board := &Leaderboard{file: file, limit: limit}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var finish BestFinish
+		if err := json.Unmarshal(scanner.Bytes(), &finish); err != nil {
+			// A torn line from a crash mid-write, the rest is still good
+			slog.Warn("skipping leaderboard entry", "err", err)
+			continue
+		}
+		board.insert(finish)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return board, nil
+}
+
+// Appends the finish to the store and ranks it
+func (l *Leaderboard) Record(finish BestFinish) error {
+	line, err := json.Marshal(finish)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.insert(finish)
+	return nil
+}
+
+// Returns a copy of the fastest finishes
+func (l *Leaderboard) Top() []BestFinish {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]BestFinish{}, l.top...)
+}
+
+func (l *Leaderboard) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Identifies an entry for the admin console, unique enough within a game
+func (f BestFinish) Key() string {
+	return fmt.Sprintf("%v-%v", f.GameID, f.FinishedAt.UnixNano())
+}
+
+// Drops every entry
+func (l *Leaderboard) Clear() (int, error) {
+	return l.rewrite(func(finish *BestFinish) bool { return false })
+}
+
+// Drops the entry with the key
+func (l *Leaderboard) Remove(key string) error {
+	n, err := l.rewrite(func(finish *BestFinish) bool { return finish.Key() != key })
+	if err == nil && n == 0 {
+		err = fmt.Errorf("Leaderboard entry doesn't exists")
+	}
+	return err
+}
+
+// Changes the player name of the entry with the key
+func (l *Leaderboard) Rename(key, name string) error {
+	n := 0
+	_, err := l.rewrite(func(finish *BestFinish) bool {
+		if finish.Key() == key {
+			finish.PlayerName = name
+			n++
+		}
+		return true
+	})
+	if err == nil && n == 0 {
+		err = fmt.Errorf("Leaderboard entry doesn't exists")
+	}
+	return err
+}
+
+// Rewrites the store with the entries keep lets through, possibly edited, and ranks them again
+// The new file replaces the old one atomically, a crash leaves one or the other
+// returns the number of entries dropped
+func (l *Leaderboard) rewrite(keep func(finish *BestFinish) bool) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	kept := []BestFinish{}
+	dropped := 0
+	scanner := bufio.NewScanner(l.file)
+	for scanner.Scan() {
+		var finish BestFinish
+		if err := json.Unmarshal(scanner.Bytes(), &finish); err != nil {
+			continue
+		}
+		if keep(&finish) {
+			kept = append(kept, finish)
+		} else {
+			dropped++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	path := l.file.Name()
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	enc := json.NewEncoder(tmp)
+	for _, finish := range kept {
+		if err := enc.Encode(finish); err != nil {
+			tmp.Close()
+			return 0, err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	l.file.Close()
+	l.file = file
+
+	l.top = nil
+	for _, finish := range kept {
+		l.insert(finish)
+	}
+	return dropped, nil
+}
+
+// Keeps the finish if it ranks within the limit
+func (l *Leaderboard) insert(finish BestFinish) {
+	i := sort.Search(len(l.top), func(i int) bool {
+		return l.top[i].Elasped > finish.Elasped
+	})
+	if l.limit > 0 && i >= l.limit {
+		return
+	}
+
+	l.top = append(l.top, BestFinish{})
+	copy(l.top[i+1:], l.top[i:])
+	l.top[i] = finish
+	if l.limit > 0 && len(l.top) > l.limit {
+		l.top = l.top[:l.limit]
+	}
+}
+
+// Stores the finishes of one engine command
+func (h *GameHandler) recordFinishes(events []DomainEvent) {
+	for _, ev := range events {
+		completed, ok := ev.(Completed)
+		if !ok {
+			continue
+		}
+
+		err := h.Leaderboard.Record(BestFinish{
+			PlayerName: completed.Name,
+			Elasped:    completed.Elapsed,
+			GameID:     h.Game.ID,
+			BoardID:    h.Game.BoardID,
+			Rolls:      completed.Rolls,
+			FinishedAt: completed.Time,
+		})
+		if err != nil {
+			slog.Error("error while recording finish", "game_id", h.Game.ID, "action", "finish", "player_id", completed.PlayerID, "err", err)
+		}
+	}
+}
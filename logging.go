@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* Logging: leveled slog output, one logger per request carrying its request ID */
+
+// gin.Context key of the request logger, gin.Context.Value looks string keys up in c.Keys
+const loggerKey = "logger"
+
+// Incoming request IDs are kept only when they look like one
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// Text or JSON lines on stderr at LOG_LEVEL and above
+func NewLogger(cfg *Config) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: logLevels[cfg.LogLevel]}
+	if cfg.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+// slog has no Fatal, startup errors log and exit like log.Fatalf did
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Logger of the request, the default one outside requests
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+			return logger
+		}
+	}
+	return slog.Default()
+}
+
+// Logger for lines about an action in a game, the player is left out when there is none
+func gameLogger(logger *slog.Logger, gameID, action, playerID string) *slog.Logger {
+	args := []any{"game_id", gameID, "action", action}
+	if playerID != "" {
+		args = append(args, "player_id", playerID)
+	}
+	return logger.With(args...)
+}
+
+// Logger of the request for the player's action in the current game
+// The action and player are also recorded for the request's access log line
+func (h *GameHandler) actionLogger(ctx context.Context, action, playerID string) *slog.Logger {
+	if c, ok := ctx.(*gin.Context); ok {
+		c.Set("action", action)
+		c.Set("player_id", playerID)
+	}
+	return gameLogger(loggerFrom(ctx), h.Game.ID, action, playerID)
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Tags every request with an ID, taken from X-Request-ID or generated, and a logger carrying it
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Header("X-Request-ID", id)
+		c.Set("request_id", id)
+		c.Set(loggerKey, slog.Default().With("request_id", id))
+		c.Next()
+	}
+}
+
+// One line per request once it's done; probes and metrics scrapes only at debug level
+func (h *GameHandler) AccessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		action := c.GetString("action")
+		if action == "" {
+			action = route
+		}
+		playerID := c.GetString("player_id")
+		if playerID == "" {
+			playerID, _ = h.currentPlayerIDFromCookie(c)
+		}
+
+		level := slog.LevelInfo
+		switch status := c.Writer.Status(); {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case route == "/healthz" || route == "/readyz" || route == "/metrics" || strings.HasPrefix(route, "/static/"):
+			level = slog.LevelDebug
+		}
+
+		gameLogger(loggerFrom(c), h.Game.ID, action, playerID).Log(c, level, "request",
+			"method", c.Request.Method,
+			"route", route,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"latency", time.Since(start),
+			"client_ip", c.ClientIP(),
+		)
+	}
+}
@@ -1,19 +1,48 @@
 package main
 
 import (
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
 
-	"github.com/joho/godotenv"
+	"github.com/gin-gonic/gin"
 )
 
 func main() {
-	log.Printf("Loading env(s)...")
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("error loading env | err: %v\n", err)
+	hubAddr := flag.String("hub", "", "only run the broker hub on this address (host:port or unix:/path)")
+	configFile := flag.String("config", ".env", "optional file of KEY=VALUE settings, overridden by env and flags")
+	printConfig := flag.Bool("print-config", false, "print the resolved configuration and exit")
+	given := ConfigFlags(flag.CommandLine)
+	flag.Parse()
+
+	cfg, err := LoadConfig(*configFile, given)
+	if *printConfig && cfg != nil {
+		cfg.Print(os.Stdout)
+	}
+	if err != nil {
+		fatal("invalid config", "err", err)
+	}
+	if *printConfig {
+		return
 	}
+	slog.SetDefault(NewLogger(cfg))
+
+	// The hub only lets in instances that know the cluster secret
+	if *hubAddr != "" {
+		if cfg.ClusterSecret == "" {
+			fatal("CLUSTER_SECRET is required to run the broker hub")
+		}
+		fatal("error while running broker hub", "err", NewHub(cfg.ClusterSecret).ListenAndServe(*hubAddr))
+	}
+	gin.SetMode(cfg.GinMode)
 
 	// Creating Router
-	router := Arise()
-	router.Run(":" + os.Getenv("PORT"))
+	router, h := Arise(cfg)
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%v", cfg.Port),
+		Handler: router,
+	}
+	Serve(srv, h, cfg.ShutdownTimeout)
 }
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* Metrics: counters, gauges and histograms exposed in the Prometheus text format */
+
+// Upper bounds in seconds, same as the Prometheus client defaults
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Anything that writes its samples to the exposition
+type collector interface {
+	collect(w io.Writer)
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Renders {a="1",b="2"}, escaping the values as the format requires
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type Counter struct {
+	name, help string
+	val        atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.val.Add(1)
+}
+
+func (c *Counter) collect(w io.Writer) {
+	writeHeader(w, c.name, "counter", c.help)
+	fmt.Fprintf(w, "%v %v\n", c.name, c.val.Load())
+}
+
+// Gauge or counter read from elsewhere at scrape time
+type valueFunc struct {
+	name, help, kind string
+	fn               func() float64
+}
+
+func (f *valueFunc) collect(w io.Writer) {
+	writeHeader(w, f.name, f.kind, f.help)
+	fmt.Fprintf(w, "%v %v\n", f.name, formatFloat(f.fn()))
+}
+
+// Counter with one series per label value, read from elsewhere at scrape time
+type counterMapFunc struct {
+	name, help, label string
+	fn                func() map[string]uint64
+}
+
+func (f *counterMapFunc) collect(w io.Writer) {
+	writeHeader(w, f.name, "counter", f.help)
+	values := f.fn()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%v%v %v\n", f.name, formatLabels([]string{f.label}, []string{key}), values[key])
+	}
+}
+
+type histogramSeries struct {
+	labels []string
+	// Cumulative counts per bucket, the last one is +Inf
+	counts []uint64
+	sum    float64
+}
+
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+func (h *HistogramVec) Observe(d time.Duration, labelValues ...string) {
+	seconds := d.Seconds()
+	key := strings.Join(labelValues, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labels: labelValues, counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			s.counts[i]++
+		}
+	}
+	s.counts[len(h.buckets)]++
+	s.sum += seconds
+}
+
+func (h *HistogramVec) collect(w io.Writer) {
+	writeHeader(w, h.name, "histogram", h.help)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	names := append(append([]string(nil), h.labels...), "le")
+	for _, key := range keys {
+		s := h.series[key]
+		for i, count := range s.counts {
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatFloat(h.buckets[i])
+			}
+			values := append(append([]string(nil), s.labels...), le)
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, formatLabels(names, values), count)
+		}
+		labels := formatLabels(h.labels, s.labels)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.name, labels, formatFloat(s.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.name, labels, s.counts[len(h.buckets)])
+	}
+}
+
+type Metrics struct {
+	mu         sync.Mutex
+	collectors []collector
+
+	Rolls           *Counter
+	GamesCompleted  *Counter
+	RenderDuration  *HistogramVec
+	RequestDuration *HistogramVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.Rolls = m.counter("portals_dice_rolls_total", "Dice rolls made.")
+	m.GamesCompleted = m.counter("portals_games_completed_total", "Players who reached the last cell.")
+	m.RenderDuration = m.histogram("portals_render_duration_seconds", "Time spent rendering templates for broadcasts.", "template")
+	m.RequestDuration = m.histogram("portals_http_request_duration_seconds", "HTTP request latency, streams included.", "method", "route", "code")
+	return m
+}
+
+func (m *Metrics) register(c collector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectors = append(m.collectors, c)
+}
+
+func (m *Metrics) counter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	m.register(c)
+	return c
+}
+
+func (m *Metrics) histogram(name, help string, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: defaultBuckets, series: map[string]*histogramSeries{}}
+	m.register(h)
+	return h
+}
+
+// Gauge evaluated on every scrape
+func (m *Metrics) GaugeFunc(name, help string, fn func() float64) {
+	m.register(&valueFunc{name: name, help: help, kind: "gauge", fn: fn})
+}
+
+// Counter kept elsewhere, read on every scrape
+func (m *Metrics) CounterFunc(name, help string, fn func() float64) {
+	m.register(&valueFunc{name: name, help: help, kind: "counter", fn: fn})
+}
+
+// Counter kept elsewhere with one series per label value
+func (m *Metrics) CounterMapFunc(name, help, label string, fn func() map[string]uint64) {
+	m.register(&counterMapFunc{name: name, help: help, label: label, fn: fn})
+}
+
+// Writes every metric in registration order
+func (m *Metrics) Expose(w io.Writer) {
+	m.mu.Lock()
+	collectors := append([]collector(nil), m.collectors...)
+	m.mu.Unlock()
+
+	for _, c := range collectors {
+		c.collect(w)
+	}
+}
+
+// Times every request by matched route, unmatched paths share one series
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		m.RequestDuration.Observe(time.Since(start), c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+	}
+}
+
+func (m *Metrics) Handler(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	m.Expose(c.Writer)
+}
+
+// Registers the game and broker metrics and times every template render
+// Called before the server starts, so nothing renders while Render is swapped
+func (h *GameHandler) Instrument(m *Metrics) {
+	h.Metrics = m
+
+	m.GaugeFunc("portals_sse_clients", "Subscribers connected to /events and /ws.", func() float64 {
+		return float64(h.Broker.Stats().Clients)
+	})
+	m.CounterFunc("portals_broker_drops_total", "Broadcasts dropped for subscribers that were behind.", func() float64 {
+		return float64(h.Broker.Stats().Drops)
+	})
+	m.CounterFunc("portals_broker_evictions_total", "Subscribers evicted for dropping too many broadcasts.", func() float64 {
+		return float64(h.Broker.Stats().Evictions)
+	})
+	m.CounterFunc("portals_broker_resyncs_total", "Full re-renders sent to subscribers that caught up.", func() float64 {
+		return float64(h.Broker.Stats().Resyncs)
+	})
+	m.CounterMapFunc("portals_broadcasts_total", "Broadcasts published, by event.", "event", func() map[string]uint64 {
+		return h.Broker.Stats().Broadcasts
+	})
+	m.GaugeFunc("portals_players", "Players in the game.", func() float64 {
+		joined, _ := h.Game.PlayerCounts()
+		return float64(joined)
+	})
+	m.GaugeFunc("portals_active_players", "Players in the game who haven't finished the round.", func() float64 {
+		_, active := h.Game.PlayerCounts()
+		return float64(active)
+	})
+
+	h.Engine.Subscribe(func(events []DomainEvent) {
+		// The owner counts the game's events, not every replica of them
+		if h.Cluster.Writable() != nil {
+			return
+		}
+		for _, ev := range events {
+			switch ev.(type) {
+			case DiceRolled:
+				m.Rolls.Inc()
+			case Completed:
+				m.GamesCompleted.Inc()
+			}
+		}
+	})
+
+	render := h.Render
+	h.Render = func(name string, data any) string {
+		start := time.Now()
+		out := render(name, data)
+		m.RenderDuration.Observe(time.Since(start), name)
+		return out
+	}
+}
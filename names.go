@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Rules applied to player names before they join the game
+type NamePolicy struct {
+	MaxLen    int
+	Blocklist []string
+}
+
+func NewNamePolicy(cfg *Config) *NamePolicy {
+	policy := &NamePolicy{
+		MaxLen: cfg.MaxNameLen,
+	}
+
+	if path := cfg.NameBlocklistFile; path != "" {
+		words, err := loadBlocklist(path)
+		if err != nil {
+			fatal("error while loading NAME_BLOCKLIST_FILE", "path", path, "err", err)
+		}
+		policy.Blocklist = words
+	}
+
+	return policy
+}
+
+// Reads one blocked word per line, skipping blanks and # comments
+func loadBlocklist(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	words := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		words = append(words, strings.ToLower(norm.NFC.String(word)))
+	}
+
+	return words, scanner.Err()
+}
+
+// Trims, NFC-normalizes and validates the given name
+// returns the cleaned name or an error describing why it was rejected
+func (p *NamePolicy) Normalize(name string) (string, error) {
+	name = norm.NFC.String(name)
+	name = strings.Join(strings.Fields(name), " ")
+
+	if name == "" {
+		return "", fmt.Errorf("Name required")
+	}
+
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return "", fmt.Errorf("Name contains invalid characters")
+		}
+	}
+
+	if utf8.RuneCountInString(name) > p.MaxLen {
+		return "", fmt.Errorf("Name must be at most %v characters", p.MaxLen)
+	}
+
+	lowered := strings.ToLower(name)
+	for _, word := range p.Blocklist {
+		if strings.Contains(lowered, word) {
+			return "", fmt.Errorf("Name is not allowed")
+		}
+	}
+
+	return name, nil
+}
+
+// Cuts a raw name to MaxLen characters, so a rejected name of any length can be
+// echoed back into the join form
+func (p *NamePolicy) Clip(name string) string {
+	if utf8.RuneCountInString(name) <= p.MaxLen {
+		return name
+	}
+	return string([]rune(name)[:p.MaxLen])
+}
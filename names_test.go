@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	policy := &NamePolicy{MaxLen: 8, Blocklist: []string{"badword", "caf\u00e9"}}
+
+	tests := []struct {
+		name string
+		raw  string
+		want string
+		err  string
+	}{
+		{name: "plain", raw: "Bob", want: "Bob"},
+		{name: "trimmed", raw: "  Bob \t", want: "Bob"},
+		{name: "inner whitespace collapsed", raw: "Bob \t\n Ann", want: "Bob Ann"},
+		{name: "NFC", raw: "Jose\u0301", want: "Jos\u00e9"},
+		{name: "empty", raw: "", err: "Name required"},
+		{name: "whitespace only", raw: " \t \n", err: "Name required"},
+		{name: "control character", raw: "Bo\x07b", err: "Name contains invalid characters"},
+		{name: "format character", raw: "Bo\u200bb", err: "Name contains invalid characters"},
+		{name: "at the limit", raw: "Abcdefgh", want: "Abcdefgh"},
+		{name: "limit counts characters", raw: strings.Repeat("\u00e9", 8), want: strings.Repeat("\u00e9", 8)},
+		{name: "limit after NFC", raw: "Abcdefge\u0301", want: "Abcdefg\u00e9"},
+		{name: "too long", raw: "Abcdefghi", err: "Name must be at most 8 characters"},
+		{name: "blocked", raw: "BadWord!", err: "Name is not allowed"},
+		{name: "blocked after NFC", raw: "CAFE\u0301", err: "Name is not allowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := policy.Normalize(tt.raw)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("Normalize(%q) = %q, %v; want error %q", tt.raw, got, err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("Normalize(%q) = %q, %v; want %q", tt.raw, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestJoinRejectsDuplicateNames(t *testing.T) {
+	_, h := newTestHandler(t, nil)
+	if _, err := h.join(t.Context(), "p1", "Bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{name: "same", raw: "Bob"},
+		{name: "other case", raw: "bOB"},
+		{name: "padded", raw: "  bob  "},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := h.join(t.Context(), fmt.Sprintf("p%v", i+2), tt.raw)
+			if err == nil || err.Error() != "Name is already taken" {
+				t.Fatalf("join(%q) = %v, want Name is already taken", tt.raw, err)
+			}
+		})
+	}
+}
+
+func TestJoinFormEchoIsClipped(t *testing.T) {
+	router, h := newTestHandler(t, map[string]string{"MAX_NAME_LEN": "8"})
+
+	form := url.Values{"player_name": {strings.Repeat("x", 10_000)}}
+	req := httptest.NewRequest(http.MethodPost, "/join", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: playerCookie, Value: newPlayerToken()})
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	body, _ := io.ReadAll(rec.Body)
+	if !strings.Contains(string(body), "Name must be at most 8 characters") {
+		t.Fatalf("join form has no length error:\n%s", body)
+	}
+	if !strings.Contains(string(body), `value="xxxxxxxx"`) || strings.Contains(string(body), "xxxxxxxxx") {
+		t.Fatalf("join form echoes more than %v characters:\n%s", h.Names.MaxLen, body)
+	}
+}
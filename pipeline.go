@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Coalesces fragment updates after Game changes
+// Handlers mark topics dirty; after the debounce window every dirty topic is
+// rendered once for that version and fanned out to subscribers as one batch
+type Pipeline struct {
+	// Held for a whole flush so batches go out in version order
+	flushMu sync.Mutex
+
+	mu      sync.Mutex
+	dirty   map[string]bool
+	pending bool
+	version uint64
+
+	window time.Duration
+	broker Broker
+	// Called once per flush, returns the renderer for that version's topics
+	renderer func() func(topic, me string) Message
+}
+
+func NewPipeline(broker Broker, renderer func() func(topic, me string) Message, window time.Duration) *Pipeline {
+	return &Pipeline{
+		dirty:    map[string]bool{},
+		window:   window,
+		broker:   broker,
+		renderer: renderer,
+	}
+}
+
+// Schedules the topics for the next flush
+func (p *Pipeline) MarkDirty(topics ...string) {
+	p.mu.Lock()
+	for _, topic := range topics {
+		p.dirty[topic] = true
+	}
+
+	if p.window <= 0 {
+		p.mu.Unlock()
+		p.Flush()
+		return
+	}
+
+	if !p.pending {
+		p.pending = true
+		time.AfterFunc(p.window, p.Flush)
+	}
+	p.mu.Unlock()
+}
+
+// Renders every dirty topic once and sends the batch
+func (p *Pipeline) Flush() {
+	p.flushMu.Lock()
+	defer p.flushMu.Unlock()
+
+	p.mu.Lock()
+	dirty := p.dirty
+	p.dirty = map[string]bool{}
+	p.pending = false
+	if len(dirty) == 0 {
+		p.mu.Unlock()
+		return
+	}
+	p.version++
+	p.mu.Unlock()
+
+	render := p.renderer()
+	batch := []Message{}
+	for _, topic := range Topics {
+		if !dirty[topic] {
+			continue
+		}
+
+		if topic == "dice" {
+			// Dice controls depend on who is looking, so they are rendered per recipient
+			for _, me := range p.broker.PlayerIDs(topic) {
+				msg := render(topic, me)
+				msg.Targeted, msg.To = true, me
+				batch = append(batch, msg)
+			}
+			continue
+		}
+
+		if p.broker.Wants(topic) {
+			batch = append(batch, render(topic, ""))
+		}
+	}
+
+	p.broker.BroadcastBatch(batch)
+}
+
+// Number of batches flushed so far
+func (p *Pipeline) Version() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.version
+}
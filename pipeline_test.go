@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Handler on a fresh game, with every file kept in a temp dir
+func newTestHandler(tb testing.TB, settings map[string]string) (*gin.Engine, *GameHandler) {
+	tb.Helper()
+	gin.SetMode(gin.TestMode)
+
+	dir := tb.TempDir()
+	flags := map[string]string{
+		"GIN_MODE":                  gin.TestMode,
+		"EVENT_LOG_FILE":            filepath.Join(dir, "events.jsonl"),
+		"LEADERBOARD_FILE":          filepath.Join(dir, "leaderboard.jsonl"),
+		"SNAPSHOT_FILE":             filepath.Join(dir, "snapshot.json"),
+		"SNAPSHOT_INTERVAL_SECONDS": "0",
+	}
+	for key, val := range settings {
+		flags[key] = val
+	}
+
+	cfg, err := LoadConfig("", flags)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	// Logs only with -v
+	if testing.Verbose() {
+		slog.SetDefault(NewLogger(cfg))
+	} else {
+		slog.SetDefault(slog.New(slog.DiscardHandler))
+	}
+
+	router, h := Arise(cfg)
+	tb.Cleanup(func() {
+		h.Drain()
+		if err := h.Close(); err != nil {
+			tb.Error(err)
+		}
+	})
+	return router, h
+}
+
+// Players seated for the benchmarks, as many as a full default game
+const benchmarkPlayers = 3
+
+// Seats the players and opens one drained subscriber per player on every topic
+func benchmarkGame(b *testing.B) *GameHandler {
+	_, h := newTestHandler(b, map[string]string{"BROADCAST_DEBOUNCE_MS": "0"})
+	for i := range benchmarkPlayers {
+		id := fmt.Sprintf("player-%v", i)
+		if _, err := h.join(b.Context(), id, fmt.Sprintf("Player %v", i)); err != nil {
+			b.Fatal(err)
+		}
+
+		ch := make(chan Message, 8)
+		h.Broker.Add(ch, id, nil)
+		go func() {
+			for range ch {
+			}
+		}()
+	}
+	return h
+}
+
+// Every topic rendered from its own template and broadcast on its own
+func BenchmarkDirectBroadcast(b *testing.B) {
+	h := benchmarkGame(b)
+
+	b.ResetTimer()
+	for range b.N {
+		for _, topic := range Topics {
+			if topic == "dice" {
+				h.Broker.BroadcastEach(topic, func(me string) string {
+					return h.renderTopic(h.Game.Snapshot(), topic, me)
+				})
+				continue
+			}
+			h.Broker.Broadcast(topic, h.renderTopic(h.Game.Snapshot(), topic, ""))
+		}
+	}
+}
+
+// Every topic marked dirty, rendered once and sent as one batch
+// Without a debounce window MarkDirty flushes right away
+func BenchmarkPipelineFlush(b *testing.B) {
+	h := benchmarkGame(b)
+
+	b.ResetTimer()
+	for range b.N {
+		h.Pipeline.MarkDirty(Topics...)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import "fmt"
+
+/* Rebuilding a Game from its domain events */
+
+// Rebuilds a game by applying its events in order, starting from GameCreated
+func ReplayGame(events []DomainEvent) (*Game, error) {
+	if len(events) == 0 {
+		return nil, fmt.Errorf("No events to replay")
+	}
+	if _, ok := events[0].(GameCreated); !ok {
+		return nil, fmt.Errorf("Game log must start with GameCreated, got %v", events[0].EventName())
+	}
+
+	game := &Game{}
+	for i, ev := range events {
+		if err := game.Apply(ev); err != nil {
+			return nil, fmt.Errorf("event %v (%v): %w", i, ev.EventName(), err)
+		}
+	}
+	return game, nil
+}
+
+// Applies the state change recorded by the event
+// Events carry outcomes, so applying them never rolls dice or reads the clock
+func (game *Game) Apply(ev DomainEvent) error {
+	game.Mu.Lock()
+	defer game.Mu.Unlock()
+
+	switch ev := ev.(type) {
+	case GameCreated:
+		game.ID = ev.GameID
+		game.BoardID = ev.GameID
+		game.Players = make(map[string]Player)
+		game.BestFinishes = nil
+		game.MaxBestFinishes = ev.MaxBestFinishes
+		game.setBoard(ev.Size, ev.Board)
+		game.Occupancy = make(map[Position][]string)
+		game.Rules = nil
+	case BoardReset:
+		// Logs from before board IDs keep the previous one
+		if ev.BoardID != "" {
+			game.BoardID = ev.BoardID
+		}
+		game.setBoard(ev.Size, ev.Board)
+		game.placeAllAtStart(ev.Time)
+	case GameStarted:
+		game.placeAllAtStart(ev.Time)
+	case PlayerJoined:
+		if _, exists := game.Players[ev.PlayerID]; exists {
+			return fmt.Errorf("Player already exists")
+		}
+		player := Player{
+			ID:       ev.PlayerID,
+			Name:     ev.Name,
+			Position: Position{Row: game.Size - 1, Col: 0},
+		}
+		player.Timer.StartAt(ev.Time)
+		game.Players[ev.PlayerID] = player
+		game.addPlayerToCell(player.ID, player.Position)
+	case PlayerLeft:
+		if _, exists := game.Players[ev.PlayerID]; !exists {
+			return fmt.Errorf("Player doesn't exists")
+		}
+		game.removePlayerFromCell(ev.PlayerID)
+		delete(game.Players, ev.PlayerID)
+	case Moved:
+		return game.placePlayer(ev.PlayerID, ev.To)
+	case Teleported:
+		return game.placePlayer(ev.PlayerID, ev.To)
+	case Completed:
+		player, exists := game.Players[ev.PlayerID]
+		if !exists {
+			return fmt.Errorf("Player doesn't exists")
+		}
+		player.Timer.Active = false
+		player.Timer.EndedAt = ev.Time
+		player.Timer.Elasped = ev.Elapsed
+		game.Players[ev.PlayerID] = player
+		game.updateBestFinishes(BestFinish{
+			PlayerName: player.Name,
+			Elasped:    ev.Elapsed,
+			GameID:     game.ID,
+			BoardID:    game.BoardID,
+			Rolls:      ev.Rolls,
+			FinishedAt: ev.Time,
+		})
+	case DiceRolled:
+		player, exists := game.Players[ev.PlayerID]
+		if !exists {
+			return fmt.Errorf("Player doesn't exists")
+		}
+		player.Rolls++
+		player.LastRoll = ev.Roll
+		game.Players[ev.PlayerID] = player
+	case RulesChanged:
+		rules := ev.Rules
+		game.Rules = &rules
+	case ChatPosted, AdminActed:
+		// No state change, whatever an admin changed has its own events
+	default:
+		return fmt.Errorf("Unknown event %T", ev)
+	}
+	return nil
+}
+
+// Installs the board and rebuilds the cell value lookup
+func (game *Game) setBoard(size int, board [][]Cell) {
+	finder := make(map[int]Position, size*size)
+	for r, row := range board {
+		for c, cell := range row {
+			finder[cell.Value] = Position{Row: r, Col: c}
+		}
+	}
+
+	game.Board = copyBoard(board)
+	game.Size = size
+	game.LastCellVal = size * size
+	game.Finder = finder
+}
+
+// Moves the player onto the cell with the given value
+func (game *Game) placePlayer(playerID string, cellVal int) error {
+	player, exists := game.Players[playerID]
+	if !exists {
+		return fmt.Errorf("Player doesn't exists")
+	}
+	pos, ok := game.Finder[cellVal]
+	if !ok {
+		return fmt.Errorf("Cell %v is not on the board", cellVal)
+	}
+
+	game.removePlayerFromCell(playerID)
+	player.Position = pos
+	game.Players[playerID] = player
+	game.addPlayerToCell(playerID, pos)
+	return nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* Replay viewer: re-streams a recorded game step by step through the board fragments */
+
+// Time between two steps at 1x
+const replayStepInterval = time.Second
+
+var replaySpeeds = []int{1, 2, 4}
+
+// Recorded game cut into steps, one per join, leave, roll or round change
+type Replay struct {
+	GameID string
+	Events []DomainEvent
+	// Events[:Ends[i]] is the game after step i; step 0 is the empty board
+	Ends []int
+	// Step of every roll, roll n is Rolls[n-1]
+	Rolls []int
+	// Sequence number of the game's last logged event
+	Seq uint64
+}
+
+// Reads the game's events from the log and splits them into steps
+func LoadReplay(path, gameID string) (*Replay, error) {
+	entries, err := ReadEventLog(path)
+	if err != nil {
+		return nil, err
+	}
+	events, err := GameEvents(entries, gameID)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	r := &Replay{GameID: gameID, Events: events, Ends: []int{1}}
+	for _, entry := range entries {
+		if entry.GameID == gameID {
+			r.Seq = entry.Seq
+		}
+	}
+	for i := 1; i < len(events); i++ {
+		switch events[i].(type) {
+		case Moved, Teleported, Completed, ChatPosted, RulesChanged, AdminActed:
+			// Part of the current step
+			r.Ends[len(r.Ends)-1] = i + 1
+			continue
+		case DiceRolled:
+			r.Rolls = append(r.Rolls, len(r.Ends))
+		}
+		r.Ends = append(r.Ends, i+1)
+	}
+	return r, nil
+}
+
+// Replays viewed most recently, so seeking and playing don't re-read the log
+const replayCacheSize = 8
+
+type ReplayCache struct {
+	mu      sync.Mutex
+	replays map[string]*Replay
+	// Game IDs, least recently used first
+	order []string
+}
+
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{replays: map[string]*Replay{}}
+}
+
+// Returns the cached replay while no event of its game was logged after it,
+// reading the log again otherwise
+func (rc *ReplayCache) Load(eventLog *EventLog, gameID string) (*Replay, error) {
+	rc.mu.Lock()
+	replay, ok := rc.replays[gameID]
+	rc.mu.Unlock()
+	if ok && replay.Seq >= eventLog.GameSeq(gameID) {
+		rc.touch(replay)
+		return replay, nil
+	}
+
+	replay, err := LoadReplay(eventLog.Path(), gameID)
+	if err != nil {
+		return nil, err
+	}
+	rc.touch(replay)
+	return replay, nil
+}
+
+// Stores the replay as the most recently used, evicting the oldest past the size
+func (rc *ReplayCache) touch(replay *Replay) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if cached, ok := rc.replays[replay.GameID]; ok && cached.Seq > replay.Seq {
+		return
+	}
+	rc.replays[replay.GameID] = replay
+	rc.order = slices.DeleteFunc(rc.order, func(id string) bool { return id == replay.GameID })
+	rc.order = append(rc.order, replay.GameID)
+	if len(rc.order) > replayCacheSize {
+		delete(rc.replays, rc.order[0])
+		rc.order = rc.order[1:]
+	}
+}
+
+func (r *Replay) LastStep() int {
+	return len(r.Ends) - 1
+}
+
+// Clamps the step into the recorded range
+func (r *Replay) clamp(step int) int {
+	return max(0, min(step, r.LastStep()))
+}
+
+// Step at which the given roll was made, 0 is the start of the game
+func (r *Replay) StepOfRoll(roll int) int {
+	if roll <= 0 || len(r.Rolls) == 0 {
+		return 0
+	}
+	return r.Rolls[min(roll, len(r.Rolls))-1]
+}
+
+// Number of rolls made up to and including the step
+func (r *Replay) RollAt(step int) int {
+	n := 0
+	for _, s := range r.Rolls {
+		if s <= step {
+			n++
+		}
+	}
+	return n
+}
+
+// Game state right after the step
+func (r *Replay) GameAt(step int) (*Game, error) {
+	return ReplayGame(r.Events[:r.Ends[r.clamp(step)]])
+}
+
+// Human readable summary of what happened in the step
+func (r *Replay) Caption(step int) string {
+	step = r.clamp(step)
+	if step == 0 {
+		return "The game was created"
+	}
+
+	var rolled DiceRolled
+	caption := ""
+	for _, ev := range r.Events[r.Ends[step-1]:r.Ends[step]] {
+		switch ev := ev.(type) {
+		case PlayerJoined:
+			caption = fmt.Sprintf("%v has joined the game", ev.Name)
+		case PlayerLeft:
+			caption = fmt.Sprintf("%v has left the game", ev.Name)
+		case DiceRolled:
+			rolled = ev
+			caption = fmt.Sprintf("%v got %v and couldn't move", ev.Name, ev.Roll)
+		case Moved:
+			caption = fmt.Sprintf("%v got %v and has moved to %v", ev.Name, rolled.Roll, ev.To)
+		case Teleported:
+			caption = fmt.Sprintf("%v got %v and has teleported to %v", ev.Name, rolled.Roll, ev.To)
+		case Completed:
+			caption = fmt.Sprintf("%v has completed the game, took %v", ev.Name, ev.Elapsed)
+		case GameStarted:
+			caption = "A new round has started"
+		case BoardReset:
+			caption = "The board has been regenerated"
+		}
+	}
+	return caption
+}
+
+// Playback position and controls shown with the board
+type ReplayView struct {
+	GameID   string
+	Step     int
+	Steps    int
+	Roll     int
+	Rolls    int
+	Speed    int
+	Speeds   []int
+	Playing  bool
+	Finished bool
+	Caption  string
+}
+
+func (r *Replay) View(step, speed int, playing bool) ReplayView {
+	step = r.clamp(step)
+	return ReplayView{
+		GameID:   r.GameID,
+		Step:     step,
+		Steps:    r.LastStep(),
+		Roll:     r.RollAt(step),
+		Rolls:    len(r.Rolls),
+		Speed:    speed,
+		Speeds:   replaySpeeds,
+		Playing:  playing && step < r.LastStep(),
+		Finished: step == r.LastStep(),
+		Caption:  r.Caption(step),
+	}
+}
+
+// Loads the replay named in the path, answering 404 for unknown games
+func (h *GameHandler) loadReplay(c *gin.Context) (*Replay, bool) {
+	replay, err := h.Replays.Load(h.Log, c.Param("gameID"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.String(http.StatusNotFound, "Game not found")
+		} else {
+			c.String(http.StatusInternalServerError, err.Error())
+		}
+		return nil, false
+	}
+	return replay, true
+}
+
+// Reads step, roll, speed and paused from the query
+// roll takes precedence over step, so the seek form can jump to a roll
+func parsePlayback(c *gin.Context, replay *Replay) (step, speed int, playing bool) {
+	step, _ = strconv.Atoi(c.Query("step"))
+	if roll := c.Query("roll"); roll != "" {
+		n, _ := strconv.Atoi(roll)
+		step = replay.StepOfRoll(n)
+	}
+
+	speed, _ = strconv.Atoi(c.Query("speed"))
+	if !slices.Contains(replaySpeeds, speed) {
+		speed = 1
+	}
+	return replay.clamp(step), speed, c.Query("paused") == ""
+}
+
+func replayData(replay *Replay, game *Game, step, speed int, playing bool) gin.H {
+	snap := game.Snapshot()
+	return gin.H{
+		"Game":        snap,
+		"Replay":      replay.View(step, speed, playing),
+		"Leaderboard": snap.BestFinishes,
+	}
+}
+
+// Page with the board at the requested step, playing from there unless paused
+func (h *GameHandler) ReplayPage(c *gin.Context) {
+	h.renderReplay(c, "replay.html")
+}
+
+// Player fragment swapped in by the controls
+func (h *GameHandler) ReplayPlayer(c *gin.Context) {
+	h.renderReplay(c, "_replay_player.html")
+}
+
+func (h *GameHandler) renderReplay(c *gin.Context, name string) {
+	replay, ok := h.loadReplay(c)
+	if !ok {
+		return
+	}
+
+	step, speed, playing := parsePlayback(c, replay)
+	game, err := replay.GameAt(step)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.HTML(http.StatusOK, name, replayData(replay, game, step, speed, playing))
+}
+
+// Streams the steps after ?step= at the requested speed
+// Each frame carries its step as the event id, so a reconnect resumes there
+func (h *GameHandler) ReplayEvents(c *gin.Context) {
+	replay, ok := h.loadReplay(c)
+	if !ok {
+		return
+	}
+
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	c.Writer.Header().Set("X-Accel-Buffering", "no")
+
+	step, speed, _ := parsePlayback(c, replay)
+	if lastID, err := strconv.Atoi(c.GetHeader("Last-Event-ID")); err == nil {
+		step = replay.clamp(lastID)
+	}
+
+	game, err := replay.GameAt(step)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w := newSSEWriter(c.Writer, h.SSE.WriteTimeout)
+	if err := w.Write(h.SSE.retryFrame()); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(replayStepInterval / time.Duration(speed))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-h.quit:
+			w.Write(h.restartingFrame())
+			return
+		case <-ticker.C:
+			if step >= replay.LastStep() {
+				// Finished: keep the stream open so the client doesn't start over
+				if h.SSE.Heartbeat > 0 {
+					ticker.Reset(h.SSE.Heartbeat)
+				}
+				if err := w.Write(": ping\n\n"); err != nil {
+					return
+				}
+				continue
+			}
+
+			// Moving the game forward by one step
+			step++
+			for _, ev := range replay.Events[replay.Ends[step-1]:replay.Ends[step]] {
+				if err := game.Apply(ev); err != nil {
+					loggerFrom(c).Error("error while replaying game", "game_id", replay.GameID, "action", "replay", "step", step, "err", err)
+					return
+				}
+			}
+
+			if err := w.Write(h.replayFrames(replayData(replay, game, step, speed, true), step)...); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Board, tokens, players, leaderboard and controls for the step
+func (h *GameHandler) replayFrames(data gin.H, step int) []string {
+	frames := []string{}
+	for _, part := range []struct{ event, template string }{
+		{"board", "_board.html"},
+		{"tokens", "_tokens.html"},
+		{"players", "_players.html"},
+		{"leaderboard", "_leaderboard.html"},
+	} {
+		frames = append(frames, convert2sseEvent("", part.event, h.Render(part.template, data)))
+	}
+
+	// The last frame carries the step, which is where a reconnect resumes
+	frames = append(frames, convert2sseEvent(strconv.Itoa(step), "replay", h.Render("_replay_status.html", data)))
+	return frames
+}
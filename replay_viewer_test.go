@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// The cached replay is served until its game logs another event
+func TestReplayCacheFollowsLog(t *testing.T) {
+	eventLog, err := OpenEventLog(filepath.Join(t.TempDir(), "events.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eventLog.Close()
+
+	game := &Game{}
+	cfg, err := LoadConfig("", map[string]string{"BOARD_DIM": "3", "MAX_PORTALS": "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	game.InitGame(cfg)
+	if err := eventLog.Append(game.ID, game.Created(), PlayerJoined{PlayerID: "p1", Name: "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewReplayCache()
+	first, err := cache.Load(eventLog, game.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another game's events leave the replay as it is
+	if err := eventLog.Append("other", PlayerJoined{PlayerID: "p2", Name: "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := cache.Load(eventLog, game.ID); err != nil || again != first {
+		t.Fatalf("second load read the log again: %v", err)
+	}
+
+	if err := eventLog.Append(game.ID, PlayerLeft{PlayerID: "p1", Name: "Bob"}); err != nil {
+		t.Fatal(err)
+	}
+	latest, err := cache.Load(eventLog, game.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == first || latest.LastStep() != first.LastStep()+1 {
+		t.Fatalf("replay has %v steps after the leave, had %v", latest.LastStep(), first.LastStep())
+	}
+}
@@ -2,68 +2,125 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 
 	"github.com/gin-gonic/gin"
 )
 
-func Arise() *gin.Engine {
-	router := gin.Default()
+func Arise(cfg *Config) (*gin.Engine, *GameHandler) {
+	router := gin.New()
 
-	// loading static files
-	router.Static("/static", "./static")
-
-	// Loading all the templates
-	templ := template.Must(
-		template.New("all").
-			Funcs(
-				template.FuncMap{
-					"seq": func(start, end int) []int {
-						n := end - start + 1
-						if n <= 0 {
-							return []int{}
-						}
-
-						out := make([]int, n)
-						for i := range n {
-							out[i] = start + i
-						}
-						return out
-					},
-					"sub": func(x, y int) int {
-						return x - y
-					},
-				}).ParseGlob("templates/*.html"),
-	)
-	router.SetHTMLTemplate(templ)
+	// Loading all the templates, built in or from disk in dev mode
+	assets := assetsFS(cfg.Dev)
+	checkVendored(assets)
+	templates := NewTemplates(assets, template.FuncMap{
+		"seq": func(start, end int) []int {
+			n := end - start + 1
+			if n <= 0 {
+				return []int{}
+			}
+
+			out := make([]int, n)
+			for i := range n {
+				out[i] = start + i
+			}
+			return out
+		},
+		"sub": func(x, y int) int {
+			return x - y
+		},
+		"dict": func(kv ...any) map[string]any {
+			m := make(map[string]any, len(kv)/2)
+			for i := 0; i+1 < len(kv); i += 2 {
+				m[fmt.Sprint(kv[i])] = kv[i+1]
+			}
+			return m
+		},
+	}, cfg.Dev)
+	router.HTMLRender = templates
 
 	// Initializing the game
 	game := &Game{}
-	game.InitGame()
+	game.InitGame(cfg)
 
 	// Initializing the stream
-	streamer := NewStreamer()
+	streamer := NewStreamer(cfg.MaxStreams)
 
-	// Creating broker
-	broker := NewBroker()
+	// Creating broker, relayed through a broker hub when running several instances
+	cluster := NewCluster(cfg)
+	var broker Broker = NewLocalBroker(cfg)
+	if listen := cfg.BrokerHubListen; listen != "" {
+		go func() {
+			if err := NewHub(cfg.ClusterSecret).ListenAndServe(listen); err != nil {
+				fatal("error while running broker hub", "err", err)
+			}
+		}()
+	}
+	if addr := cfg.BrokerHubAddr; addr != "" {
+		broker = NewHubBroker(addr, cluster, cfg)
+	}
+
+	// Loading player name rules
+	names := NewNamePolicy(cfg)
 
 	// Func to render templates for Broadcasting
 	Render := func(name string, data any) string {
 		var buf bytes.Buffer
-		if err := templ.ExecuteTemplate(&buf, name, data); err != nil {
-			log.Printf("error while rendering | err: %v\n", err)
+		if err := templates.Get().ExecuteTemplate(&buf, name, data); err != nil {
+			slog.Error("error while rendering", "template", name, "err", err)
 			return ""
 		}
 
 		return buf.String()
 	}
-	h := NewGameHander(game, broker, streamer, Render)
+	// Event log, and the stats folded from it
+	eventLog := NewEventLog(cfg.EventLogFile)
+	stats := NewStatsBook(eventLog)
+
+	h := NewGameHander(cfg, game, broker, streamer, names, cluster, eventLog, NewLeaderboard(cfg.LeaderboardFile, cfg.MaxBestFinishes), stats, Render)
+	metrics := NewMetrics()
+	h.Instrument(metrics)
+
+	// Resuming the game from the last snapshot, or starting a new one
+	snapshots := NewSnapshotStore(cfg.SnapshotFile, cfg.SnapshotInterval)
+	if !h.Recover(snapshots) {
+		h.record(game.Created())
+	}
+	h.StartSnapshots(snapshots)
+
+	// Request IDs and access logs first, so they cover recovered panics and forwarded requests
+	router.Use(RequestID(), h.AccessLog(), gin.Recovery())
+	// Timing every request, forwarded ones included
+	router.Use(metrics.Middleware())
+	// Followers hand game requests to the instance that owns the game
+	router.Use(cluster.RouteToOwner())
+
+	// loading static files
+	router.StaticFS("/static", staticFS(assets))
+	router.GET("/healthz", h.Healthz)
+	router.GET("/readyz", h.Readyz)
+	router.GET("/metrics", metrics.Handler)
 	router.GET("/", h.SetPortalsCookie)
 	router.GET("/events", h.BroadCastEvents)
 	router.GET("/dice-roll", h.RollDice)
 	router.POST("/join", h.JoinGame)
 	router.POST("/leave", h.RemovePlayer)
+	router.GET("/ws", h.WebSocket)
+	router.GET("/board", h.GetBoard)
+	router.GET("/players/:id/stats", h.PlayerStatsPage)
+	router.GET("/replay/:gameID", h.ReplayPage)
+	router.GET("/replay/:gameID/player", h.ReplayPlayer)
+	router.GET("/replay/:gameID/events", h.ReplayEvents)
+	router.GET("/internal/fragments", cluster.InternalOnly(), h.InternalFragments)
+	router.GET("/internal/events", cluster.InternalOnly(), h.InternalEvents)
+
+	// Admin console and API, only with credentials in the config
+	h.RegisterAdmin(router)
+
+	// JSON API
+	h.RegisterAPI(router)
 
-	return router
+	return router, h
 }
@@ -1,62 +1,180 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type GameHandler struct {
-	Game   *Game
-	Broker *Broker
-	Stream *Stream
+	Config  *Config
+	Game    *Game
+	Broker  Broker
+	Stream  *Stream
+	Names   *NamePolicy
+	SSE     SSEOptions
+	Cluster *Cluster
+	Log     *EventLog
+	// Fastest finishes across games and restarts
+	Leaderboard *Leaderboard
+	// Per-player stats across games
+	Stats  *StatsBook
 	Render func(name string, data any) string
+
+	Engine    *Engine
+	Pipeline  *Pipeline
+	BoardDiff *BoardDiff
+	Snapshots *SnapshotStore
+	Metrics   *Metrics
+	Replays   *ReplayCache
+
+	// Events of the current game applied here, see Replica
+	version atomic.Uint64
+	// One replicated batch or catch-up at a time
+	replicaMu  sync.Mutex
+	catchingUp atomic.Bool
+
+	// Set once an event couldn't be logged, the game then takes no more commands
+	logFailed atomic.Bool
+
+	// Closed by Close to stop the snapshot writer, which closes done on its way out
+	stopSnapshots chan struct{}
+	snapshotsDone chan struct{}
+
+	// Closed by Drain to end open streams
+	quit      chan struct{}
+	drainOnce sync.Once
+	draining  atomic.Bool
 }
 
-func NewGameHander(game *Game, broker *Broker, streamer *Stream, render func(string, any) string) *GameHandler {
-	return &GameHandler{
-		Game:   game,
-		Broker: broker,
-		Stream: streamer,
-		Render: render,
+func NewGameHander(cfg *Config, game *Game, broker Broker, streamer *Stream, names *NamePolicy, cluster *Cluster, eventLog *EventLog, leaderboard *Leaderboard, stats *StatsBook, render func(string, any) string) *GameHandler {
+	h := &GameHandler{
+		Config:      cfg,
+		Game:        game,
+		Broker:      broker,
+		Stream:      streamer,
+		Names:       names,
+		SSE:         NewSSEOptions(cfg),
+		Cluster:     cluster,
+		Log:         eventLog,
+		Leaderboard: leaderboard,
+		Stats:       stats,
+		Render:      render,
+		quit:        make(chan struct{}),
+	}
+	h.Pipeline = NewPipeline(broker, h.topicUpdateRenderer, cfg.BroadcastDebounce)
+	h.BoardDiff = NewBoardDiff(cfg.BoardFullRenderEvery)
+	h.Engine = NewEngine(game, cfg)
+	h.Replays = NewReplayCache()
+
+	// Events are logged before they are presented
+	h.Engine.Subscribe(func(events []DomainEvent) { h.record(events...) })
+	h.Engine.Subscribe(h.replicate)
+	h.Engine.Subscribe(h.recordFinishes)
+	h.Engine.Subscribe(func(events []DomainEvent) { h.Stats.Observe(game.ID, events...) })
+	h.Engine.Subscribe(h.present)
+
+	// Only the owner mutates the game, followers apply what it replicates
+	h.Engine.SetGate(h.writable)
+	if cluster != nil {
+		cluster.Attach(h)
 	}
+	return h
 }
 
+var errLogFailed = fmt.Errorf("The event log can't be written, the game is read-only until the server restarts")
+
+// Refuses commands once the log failed, as their events would be lost on restart
+func (h *GameHandler) writable() error {
+	if h.logFailed.Load() {
+		return errLogFailed
+	}
+	return h.Cluster.Writable()
+}
+
+// Appends the events of the current game to the event log
+// The events are already applied, a failure stops any further command instead
+func (h *GameHandler) record(events ...DomainEvent) {
+	for _, ev := range events {
+		if _, ok := ev.(GameCreated); ok {
+			h.version.Store(0)
+		}
+		h.version.Add(1)
+	}
+	if err := h.Log.Append(h.Game.ID, events...); err != nil {
+		slog.Error("error while appending to the event log, refusing further commands", "game_id", h.Game.ID, "action", "record", "events", len(events), "err", err)
+		h.logFailed.Store(true)
+	}
+}
+
+// The cookie holds a private token, players are known to others by the ID derived from it
+const playerCookie = "portals_player_token"
+
 func (h *GameHandler) currentPlayerIDFromCookie(c *gin.Context) (string, error) {
-	return c.Cookie("portals_player_id")
+	token, err := c.Cookie(playerCookie)
+	if err != nil {
+		return "", err
+	}
+	return playerIDFromToken(token), nil
+}
+
+// Random, so the token can't be guessed from anything public
+func newPlayerToken() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Public ID of the player holding the token, the token can't be recovered from it
+func playerIDFromToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+func setPlayerCookie(c *gin.Context, token string) {
+	c.SetCookie(playerCookie, token, 24*60*60*7, "/", "", false, true)
 }
 
 func (h *GameHandler) SetPortalsCookie(c *gin.Context) {
-	if _, err := c.Cookie("portals_player_id"); err != nil {
-		c.SetCookie("portals_player_id", strconv.FormatInt(time.Now().UnixNano(), 36), 24*60*60*7, "/", "", false, true)
+	if _, err := c.Cookie(playerCookie); err != nil {
+		setPlayerCookie(c, newPlayerToken())
 	}
 	me, _ := h.currentPlayerIDFromCookie(c)
 	c.HTML(http.StatusOK, "index.html", gin.H{
-		"Game": h.Game,
-		"Me":   me,
+		"Game":        h.Game.Snapshot(),
+		"Me":          me,
+		"Leaderboard": h.Leaderboard.Top(),
 	})
 }
 
+// Full state as SSE frames, the last one carries lastID so replays resume from it
+func (h *GameHandler) resyncFrames(playerID string, topics []string, lastID uint64) []string {
+	initial := h.initialEvents(playerID, topics)
+	if len(initial) > 0 {
+		initial[len(initial)-1].ID = lastID
+	}
+
+	frames := make([]string, 0, len(initial))
+	for _, msg := range initial {
+		frames = append(frames, msg.SSE())
+	}
+	return frames
+}
+
 func (h *GameHandler) BroadCastEvents(c *gin.Context) {
 	c.Writer.Header().Set("Content-Type", "text/event-stream")
 	c.Writer.Header().Set("Cache-Control", "no-cache")
 	c.Writer.Header().Set("Connection", "keep-alive")
 	c.Writer.Header().Set("X-Accel-Buffering", "no")
 
-	flusher, ok := c.Writer.(http.Flusher)
-	if !ok {
-		c.Status(http.StatusInternalServerError)
-		return
-	}
-
-	ch := make(chan string, 8)
-	h.Broker.Add(ch)
-	defer h.Broker.Remove(ch)
-
 	// Broadcasting initial state
 	player_id, err := h.currentPlayerIDFromCookie(c)
 	if err != nil {
@@ -64,65 +182,100 @@ func (h *GameHandler) BroadCastEvents(c *gin.Context) {
 		return
 	}
 
-	// Sending initial events
-	board := h.Render("_board.html", gin.H{"Game": h.Game})
-	players := h.Render("_players.html", gin.H{"Game": h.Game})
-	dice := h.Render("_dice.html", gin.H{"Game": h.Game, "Me": player_id})
-	tokens := h.Render("_tokens.html", gin.H{"Game": h.Game})
-	stream := h.Render("_stream_chats.html", gin.H{"Stream": h.Stream.GetLogs()})
-	leaderboard := h.Render("_leaderboard.html", gin.H{"Game": h.Game})
+	topics, err := ParseTopics(c.Query("topics"))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ch := make(chan Message, 8)
+	missed, lastID, resumed := h.Broker.Subscribe(ch, player_id, topics, c.GetHeader("Last-Event-ID"))
+	defer h.Broker.Remove(ch)
 
-	c.Writer.Write([]byte(convert2sseEvent("board", board)))
-	c.Writer.Write([]byte(convert2sseEvent("players", players)))
-	c.Writer.Write([]byte(convert2sseEvent("dice", dice)))
-	c.Writer.Write([]byte(convert2sseEvent("tokens", tokens)))
-	c.Writer.Write([]byte(convert2sseEvent("stream", stream)))
-	c.Writer.Write([]byte(convert2sseEvent("leaderboard", leaderboard)))
+	w := newSSEWriter(c.Writer, h.SSE.WriteTimeout)
+	frames := []string{h.SSE.retryFrame()}
+	if resumed {
+		// Replaying what the client missed while it was away
+		for _, msg := range missed {
+			frames = append(frames, msg.SSE())
+		}
+	} else {
+		// Sending initial events
+		frames = append(frames, h.resyncFrames(player_id, topics, lastID)...)
+	}
+	if err := w.Write(frames...); err != nil {
+		h.Broker.Evict(ch, err)
+		return
+	}
 
-	flusher.Flush()
+	// Heartbeats keep proxies from cutting idle streams and surface dead clients
+	var heartbeat <-chan time.Time
+	if h.SSE.Heartbeat > 0 {
+		ticker := time.NewTicker(h.SSE.Heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
 
 	// Pump
 	for {
 		select {
 		case <-c.Request.Context().Done():
 			return
-		case msg := <-ch:
-			_, _ = c.Writer.Write([]byte(msg))
-			flusher.Flush()
+		case <-h.quit:
+			// Shutting down: the client shows a banner and reconnects later
+			w.Write(h.restartingFrame())
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				// Evicted by the broker
+				return
+			}
+			if err := w.Write(msg.SSE()); err != nil {
+				h.Broker.Evict(ch, err)
+				return
+			}
+
+			// Catching up with a full render once the backlog has drained
+			if lastID, ok := h.Broker.TakeResync(ch); ok {
+				if err := w.Write(h.resyncFrames(player_id, topics, lastID)...); err != nil {
+					h.Broker.Evict(ch, err)
+					return
+				}
+			}
+		case <-heartbeat:
+			if err := w.Write(": ping\n\n"); err != nil {
+				h.Broker.Evict(ch, err)
+				return
+			}
+			h.Broker.CountHeartbeat()
 		}
 	}
 }
 
+// Re-renders the join form with an inline validation message
+// htmx only swaps 2xx responses, so the form is sent back with 200
+func (h *GameHandler) joinFormError(c *gin.Context, name string, err error) {
+	c.HTML(http.StatusOK, "_join_form.html", gin.H{
+		"Error": err.Error(),
+		"Name":  h.Names.Clip(name),
+	})
+}
+
 func (h *GameHandler) JoinGame(c *gin.Context) {
-	name := c.PostForm("player_name")
-	if name == "" {
-		c.String(http.StatusBadRequest, "Name required")
-		return
-	}
+	rawName := c.PostForm("player_name")
 
 	player_id, err := h.currentPlayerIDFromCookie(c)
 	if err != nil {
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
-	if err := h.Game.AddPlayer(player_id, name); err != nil {
-		c.String(http.StatusBadRequest, err.Error())
+
+	name, err := h.join(c, player_id, rawName)
+	if err != nil {
+		h.joinFormError(c, rawName, err)
 		return
 	}
 
-	h.Stream.Push(StreamLog{
-		TimeStamp: time.Now(),
-		Message:   fmt.Sprintf("%v has joined the game", name),
-		LogType:   JOIN,
-	})
-
-	// Boardcasting players + board
-	h.Broker.Broadcast("players", h.Render("_players.html", gin.H{"Game": h.Game}))
-	h.Broker.Broadcast("board", h.Render("_board.html", gin.H{"Game": h.Game}))
-	h.Broker.Broadcast("dice", h.Render("_dice.html", gin.H{"Game": h.Game}))
-	h.Broker.Broadcast("tokens", h.Render("_tokens.html", gin.H{"Game": h.Game}))
-	h.Broker.Broadcast("stream", h.Render("_stream_chats.html", gin.H{"Stream": h.Stream.GetLogs()}))
-
 	// Swaping join section
 	c.HTML(http.StatusOK, "_joined_header.html", gin.H{"PlayerName": name})
 }
@@ -134,26 +287,11 @@ func (h *GameHandler) RemovePlayer(c *gin.Context) {
 		return
 	}
 
-	playerName, err := h.Game.RemovePlayer(player_id)
-	if err != nil {
+	if _, err := h.leave(c, player_id); err != nil {
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Adding message to the streamer
-	h.Stream.Push(StreamLog{
-		TimeStamp: time.Now(),
-		Message:   fmt.Sprintf("%v has left the game", playerName),
-		LogType:   LEAVE,
-	})
-
-	// BoardCasting Events
-	h.Broker.Broadcast("players", h.Render("_players.html", gin.H{"Game": h.Game}))
-	h.Broker.Broadcast("board", h.Render("_board.html", gin.H{"Game": h.Game}))
-	h.Broker.Broadcast("dice", h.Render("_dice.html", gin.H{"Game": h.Game}))
-	h.Broker.Broadcast("tokens", h.Render("_tokens.html", gin.H{"Game": h.Game}))
-	h.Broker.Broadcast("stream", h.Render("_stream_chats.html", gin.H{"Stream": h.Stream.GetLogs()}))
-
 	c.HTML(http.StatusOK, "_join_form.html", nil)
 
 }
@@ -165,56 +303,21 @@ func (h *GameHandler) RollDice(c *gin.Context) {
 		return
 	}
 
-	roll := GetRandNumber(1, 7)
-	playerState, hasTeleported, hasMoved, hasCompleted, dest, moveErr := h.Game.MovePlayer(roll, player_id)
-	if moveErr != nil {
-		c.String(http.StatusBadRequest, moveErr.Error())
+	result, err := h.roll(c, player_id)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
 
-	if hasMoved {
-		msg := fmt.Sprintf("%v got %v and has moved to %v\n", playerState.Name, roll, dest)
-		logType := MOVE
-		if hasTeleported {
-			msg = fmt.Sprintf("%v got %v and has teleported to %v\n", playerState.Name, roll, dest)
-			logType = TELEPORTED
-		}
-
-		// Adding message to the streamer
-		h.Stream.Push(StreamLog{
-			TimeStamp: time.Now(),
-			Message:   msg,
-			LogType:   logType,
-		})
-
-		// if player has completed the game
-		if hasCompleted {
-			h.Stream.Push(StreamLog{
-				TimeStamp: time.Now(),
-				Message:   fmt.Sprintf("%v has completed the game, took %v\n", playerState.Name, playerState.Timer.Elasped),
-				LogType:   COMPLETED,
-			})
-			log.Printf("Best finishes: %v\n", h.Game.BestFinishes)
-			h.Broker.Broadcast("leaderboard", h.Render("_leaderboard.html", gin.H{"Game": h.Game}))
-		}
-	}
-
-	// BoardCasting Events
-	h.Broker.Broadcast("players", h.Render("_players.html", gin.H{"Game": h.Game}))
-	h.Broker.Broadcast("board", h.Render("_board.html", gin.H{"Game": h.Game}))
-	h.Broker.Broadcast("dice", h.Render("_dice.html", gin.H{"Game": h.Game, "Me": player_id}))
-	h.Broker.Broadcast("tokens", h.Render("_tokens.html", gin.H{"Game": h.Game}))
-	h.Broker.Broadcast("stream", h.Render("_stream_chats.html", gin.H{"Stream": h.Stream.GetLogs()}))
-
 	// Implement timer html
 
 	c.HTML(
 		http.StatusOK,
 		"_dice.html",
 		gin.H{
-			"Game":       h.Game,
+			"Game":       h.Game.Snapshot(),
 			"Me":         player_id,
-			"JustRolled": roll,
+			"JustRolled": result.Roll,
 		},
 	)
 }
@@ -0,0 +1,16 @@
+#!/bin/sh
+# Fetches the third-party JS and CSS into static/vendor, where the binary embeds them from
+# Run through `go generate` after changing a version here and in vendoredAssets (assets.go)
+set -eu
+cd "$(dirname "$0")/.."
+
+fetch() {
+	mkdir -p "$(dirname "static/vendor/$2")"
+	curl -fsSL "$1" -o "static/vendor/$2"
+	echo "fetched static/vendor/$2"
+}
+
+fetch https://unpkg.com/htmx.org@1.9.12/dist/htmx.min.js htmx@1.9.12/htmx.min.js
+fetch https://unpkg.com/htmx.org@1.9.12/dist/ext/sse.js htmx@1.9.12/ext/sse.js
+fetch https://cdn.jsdelivr.net/npm/bootstrap@5.3.8/dist/css/bootstrap.min.css bootstrap@5.3.8/css/bootstrap.min.css
+fetch https://cdn.jsdelivr.net/npm/bootstrap@5.3.8/dist/js/bootstrap.bundle.min.js bootstrap@5.3.8/js/bootstrap.bundle.min.js
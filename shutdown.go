@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+/* Graceful shutdown: stop joins, tell streams to reconnect later, drain requests, flush state */
+
+var errRestarting = fmt.Errorf("Server is restarting, try again shortly")
+
+// Stops taking joins and ends every open stream with a restarting event
+func (h *GameHandler) Drain() {
+	h.drainOnce.Do(func() {
+		h.draining.Store(true)
+		close(h.quit)
+	})
+}
+
+func (h *GameHandler) Draining() bool {
+	return h.draining.Load()
+}
+
+// Banner frame sent to SSE clients before their stream is closed
+func (h *GameHandler) restartingFrame() string {
+	return convert2sseEvent("", "restarting", h.Render("_restarting.html", nil))
+}
+
+// Saves a final snapshot, stops the engine and closes the stores
+func (h *GameHandler) Close() error {
+	var errs []error
+	if h.Snapshots != nil {
+		// A save in progress ends first, so the final snapshot is the last one written
+		close(h.stopSnapshots)
+		<-h.snapshotsDone
+
+		var saved SavedGame
+		if err := h.Engine.Exec(func(game *Game) { saved = h.captureGame(game) }); err != nil {
+			errs = append(errs, err)
+		} else if err := h.Snapshots.Save(saved); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	h.Engine.Stop()
+	if err := h.Log.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := h.Leaderboard.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Serves until SIGINT or SIGTERM, then drains and shuts down within SHUTDOWN_TIMEOUT_SECONDS
+func Serve(srv *http.Server, h *GameHandler, timeout time.Duration) {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case err := <-errs:
+		fatal("error while serving", "err", err)
+	case <-ctx.Done():
+	}
+	stop()
+	slog.Info("shutting down", "action", "shutdown", "timeout", timeout)
+
+	// Streams end on their own, so Shutdown only waits for regular requests
+	h.Drain()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("error while shutting down", "action", "shutdown", "err", err)
+	}
+
+	if err := h.Close(); err != nil {
+		slog.Error("error while flushing state", "action", "shutdown", "err", err)
+	}
+	slog.Info("server stopped", "action", "shutdown")
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/* Snapshots: the whole game and stream saved atomically to disk, restored on startup */
+
+const snapshotVersion = 1
+
+// Game state as written to a snapshot
+type SavedGameState struct {
+	ID              string            `json:"id"`
+	BoardID         string            `json:"board_id"`
+	Size            int               `json:"size"`
+	Board           [][]Cell          `json:"board"`
+	Players         map[string]Player `json:"players"`
+	BestFinishes    []BestFinish      `json:"best_finishes"`
+	MaxBestFinishes int               `json:"max_best_finishes"`
+	// Cell value -> IDs of the players on it, in arrival order
+	Occupancy map[int][]string `json:"occupancy"`
+	// Rules set by an admin, none while the configured ones apply
+	Rules *Rules `json:"rules,omitempty"`
+}
+
+type SavedGame struct {
+	Version int       `json:"version"`
+	SavedAt time.Time `json:"saved_at"`
+	// Last event log entry reflected in the game
+	Seq  uint64         `json:"seq"`
+	Game SavedGameState `json:"game"`
+	// Newest first
+	Stream []StreamLog `json:"stream"`
+}
+
+// On-disk envelope, the checksum catches truncated or corrupted files
+type snapshotFile struct {
+	Checksum string          `json:"checksum"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// Copies the game state for a snapshot
+func (game *Game) Save() SavedGameState {
+	game.Mu.Lock()
+	defer game.Mu.Unlock()
+
+	players := make(map[string]Player, len(game.Players))
+	for id, p := range game.Players {
+		players[id] = p
+	}
+
+	occupancy := make(map[int][]string, len(game.Occupancy))
+	for pos, ids := range game.Occupancy {
+		occupancy[game.Board[pos.Row][pos.Col].Value] = append([]string(nil), ids...)
+	}
+
+	return SavedGameState{
+		ID:              game.ID,
+		BoardID:         game.BoardID,
+		Size:            game.Size,
+		Board:           copyBoard(game.Board),
+		Players:         players,
+		BestFinishes:    append([]BestFinish(nil), game.BestFinishes...),
+		MaxBestFinishes: game.MaxBestFinishes,
+		Occupancy:       occupancy,
+		Rules:           copyRules(game.Rules),
+	}
+}
+
+func copyRules(rules *Rules) *Rules {
+	if rules == nil {
+		return nil
+	}
+	copied := *rules
+	return &copied
+}
+
+// Replaces the game state with the saved one
+// The saved state is checked first, an invalid one leaves the game untouched
+func (game *Game) Restore(saved SavedGameState) error {
+	if saved.Size <= 0 || len(saved.Board) != saved.Size {
+		return fmt.Errorf("snapshot board is %v rows for size %v", len(saved.Board), saved.Size)
+	}
+
+	restored := &Game{
+		ID:              saved.ID,
+		BoardID:         saved.BoardID,
+		Players:         saved.Players,
+		BestFinishes:    saved.BestFinishes,
+		MaxBestFinishes: saved.MaxBestFinishes,
+		Occupancy:       make(map[Position][]string, len(saved.Occupancy)),
+		Rules:           copyRules(saved.Rules),
+	}
+	// Snapshots from before board IDs
+	if restored.BoardID == "" {
+		restored.BoardID = restored.ID
+	}
+	if restored.Players == nil {
+		restored.Players = make(map[string]Player)
+	}
+	restored.setBoard(saved.Size, saved.Board)
+	for val, ids := range saved.Occupancy {
+		pos, ok := restored.Finder[val]
+		if !ok {
+			return fmt.Errorf("snapshot lists players on unknown cell %v", val)
+		}
+		restored.Occupancy[pos] = ids
+	}
+	if err := restored.CheckOccupancy(); err != nil {
+		return err
+	}
+
+	game.Mu.Lock()
+	defer game.Mu.Unlock()
+
+	game.ID = restored.ID
+	game.BoardID = restored.BoardID
+	game.Players = restored.Players
+	game.Board = restored.Board
+	game.Size = restored.Size
+	game.Finder = restored.Finder
+	game.LastCellVal = restored.LastCellVal
+	game.BestFinishes = restored.BestFinishes
+	game.MaxBestFinishes = restored.MaxBestFinishes
+	game.Occupancy = restored.Occupancy
+	game.Rules = restored.Rules
+	return nil
+}
+
+// Moves running timers forward so the downtime doesn't count towards Elasped
+func (game *Game) ResumeTimers(downtime time.Duration) {
+	game.Mu.Lock()
+	defer game.Mu.Unlock()
+
+	for id, player := range game.Players {
+		if player.Timer.Active {
+			player.Timer.StartedAt = player.Timer.StartedAt.Add(downtime)
+			game.Players[id] = player
+		}
+	}
+}
+
+type SnapshotStore struct {
+	// Serializes saves from the snapshot loop and shutdown
+	mu       sync.Mutex
+	path     string
+	interval time.Duration
+}
+
+// Stores snapshots at SNAPSHOT_FILE, an interval of 0 disables periodic snapshots
+func NewSnapshotStore(path string, interval time.Duration) *SnapshotStore {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		fatal("error while creating SNAPSHOT_FILE directory", "path", path, "err", err)
+	}
+
+	return &SnapshotStore{
+		path:     path,
+		interval: interval,
+	}
+}
+
+// The snapshot before the current one, kept in case the current one is unreadable
+func (s *SnapshotStore) prevPath() string {
+	return s.path + ".prev"
+}
+
+// Writes the snapshot to a temp file, syncs it and renames it over the current one
+func (s *SnapshotStore) Save(saved SavedGame) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	body, err := json.Marshal(snapshotFile{Checksum: hex.EncodeToString(sum[:]), Data: data})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// Keeping the previous snapshot as a fallback
+	if err := os.Rename(s.path, s.prevPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	// Persisting the renames
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// Returns the readable snapshots, newest first
+func (s *SnapshotStore) Load() ([]SavedGame, error) {
+	saves := []SavedGame{}
+	var firstErr error
+	for _, path := range []string{s.path, s.prevPath()} {
+		saved, err := readSnapshot(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				slog.Warn("skipping snapshot", "path", path, "err", err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		saves = append(saves, saved)
+	}
+
+	if len(saves) == 0 {
+		return nil, firstErr
+	}
+	return saves, nil
+}
+
+func readSnapshot(path string) (SavedGame, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return SavedGame{}, err
+	}
+
+	var file snapshotFile
+	if err := json.Unmarshal(body, &file); err != nil {
+		return SavedGame{}, err
+	}
+	sum := sha256.Sum256(file.Data)
+	if hex.EncodeToString(sum[:]) != file.Checksum {
+		return SavedGame{}, fmt.Errorf("checksum mismatch")
+	}
+
+	var saved SavedGame
+	if err := json.Unmarshal(file.Data, &saved); err != nil {
+		return SavedGame{}, err
+	}
+	if saved.Version != snapshotVersion {
+		return SavedGame{}, fmt.Errorf("unsupported snapshot version %v", saved.Version)
+	}
+	return saved, nil
+}
+
+// Captures the game with the stream and the log position
+// Runs on the engine goroutine, so the log holds exactly the events applied so far
+func (h *GameHandler) captureGame(game *Game) SavedGame {
+	return SavedGame{
+		Version: snapshotVersion,
+		SavedAt: time.Now().UTC(),
+		Seq:     h.Log.Seq(),
+		Game:    game.Save(),
+		Stream:  h.Stream.GetLogs(),
+	}
+}
+
+// Saves snapshots every interval and after joins, leaves, finishes and new rounds
+func (h *GameHandler) StartSnapshots(store *SnapshotStore) {
+	h.Snapshots = store
+	h.stopSnapshots = make(chan struct{})
+	h.snapshotsDone = make(chan struct{})
+	saves := make(chan SavedGame, 1)
+
+	// Keeps only the latest pending capture
+	queue := func(saved SavedGame) {
+		select {
+		case <-saves:
+		default:
+		}
+		saves <- saved
+	}
+
+	// Runs after present, so the capture includes the stream logs of the events
+	h.Engine.Subscribe(func(events []DomainEvent) {
+		for _, ev := range events {
+			switch ev.(type) {
+			case PlayerJoined, PlayerLeft, Completed, GameStarted, BoardReset, AdminActed:
+				queue(h.captureGame(h.Game))
+				return
+			}
+		}
+	})
+
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	if store.interval > 0 {
+		ticker = time.NewTicker(store.interval)
+		tick = ticker.C
+	}
+
+	go func() {
+		defer close(h.snapshotsDone)
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		var last time.Time
+		save := func(saved SavedGame) {
+			// A queued capture can be older than one taken on a tick
+			if saved.SavedAt.Before(last) {
+				return
+			}
+			if err := store.Save(saved); err != nil {
+				slog.Error("error while saving snapshot", "game_id", saved.Game.ID, "action", "snapshot", "err", err)
+				return
+			}
+			last = saved.SavedAt
+		}
+
+		for {
+			select {
+			case <-h.stopSnapshots:
+				return
+			case saved := <-saves:
+				save(saved)
+			case <-tick:
+				var saved SavedGame
+				if err := h.Engine.Exec(func(game *Game) { saved = h.captureGame(game) }); err != nil {
+					return
+				}
+				save(saved)
+			}
+		}
+	}()
+}
+
+// Restores the latest valid snapshot and the events logged after it
+// returns false when there is nothing to restore and a new game should start
+func (h *GameHandler) Recover(store *SnapshotStore) bool {
+	saves, err := store.Load()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("error while loading snapshots", "action", "recover", "err", err)
+		}
+		return false
+	}
+
+	entries, err := ReadEventLog(h.Log.Path())
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("error while reading the event log for recovery", "action", "recover", "err", err)
+	}
+
+	for _, saved := range saves {
+		// Events of the game logged after the snapshot was taken
+		tail := []DomainEvent{}
+		for _, entry := range entries {
+			if entry.GameID != saved.Game.ID || entry.Seq <= saved.Seq {
+				continue
+			}
+			ev, err := entry.Event()
+			if err != nil {
+				slog.Warn("skipping event for recovery", "game_id", entry.GameID, "action", "recover", "seq", entry.Seq, "err", err)
+				continue
+			}
+			tail = append(tail, ev)
+		}
+
+		var restoreErr error
+		applied := 0
+		h.Engine.Exec(func(game *Game) {
+			if restoreErr = game.Restore(saved.Game); restoreErr != nil {
+				return
+			}
+			for _, ev := range tail {
+				if err := game.Apply(ev); err != nil {
+					slog.Error("error while applying event after snapshot", "game_id", saved.Game.ID, "action", "recover", "event", ev.EventName(), "err", err)
+					break
+				}
+				applied++
+			}
+
+			// The server was last known alive at the later of the snapshot and the last event
+			lastSeen := saved.SavedAt
+			if applied > 0 && tail[applied-1].At().After(lastSeen) {
+				lastSeen = tail[applied-1].At()
+			}
+			game.ResumeTimers(time.Since(lastSeen))
+		})
+		if restoreErr != nil {
+			slog.Warn("skipping invalid snapshot", "game_id", saved.Game.ID, "action", "recover", "saved_at", saved.SavedAt, "err", restoreErr)
+			continue
+		}
+
+		// The version counts the game's events up to the last one applied
+		version := uint64(applied)
+		for _, entry := range entries {
+			if entry.GameID == saved.Game.ID && entry.Seq <= saved.Seq {
+				version++
+			}
+		}
+		h.version.Store(version)
+
+		h.Stream.Restore(saved.Stream)
+		h.present(tail[:applied])
+		slog.Info("restored game", "game_id", saved.Game.ID, "action", "recover", "saved_at", saved.SavedAt, "later_events", applied)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Tunables for the SSE transport
+type SSEOptions struct {
+	// Interval between ": ping" comment lines, 0 disables heartbeats
+	Heartbeat time.Duration
+	// Base reconnect delay advertised with retry:, jittered per client
+	Retry time.Duration
+	// A write (or flush) slower than this drops the client
+	WriteTimeout time.Duration
+}
+
+func NewSSEOptions(cfg *Config) SSEOptions {
+	return SSEOptions{
+		Heartbeat:    cfg.SSEHeartbeat,
+		Retry:        cfg.SSERetry,
+		WriteTimeout: cfg.SSEWriteTimeout,
+	}
+}
+
+// retry: hint spread over [Retry, 1.5*Retry) so clients don't reconnect in lockstep
+func (o SSEOptions) retryFrame() string {
+	base := int(o.Retry.Milliseconds())
+	if base <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("retry: %v\n\n", base+GetRandNumber(0, base/2+1))
+}
+
+// Writes one frame and flushes it, giving up after the write timeout
+type sseWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func newSSEWriter(w http.ResponseWriter, timeout time.Duration) *sseWriter {
+	return &sseWriter{
+		w:       w,
+		rc:      http.NewResponseController(w),
+		timeout: timeout,
+	}
+}
+
+func (s *sseWriter) Write(frames ...string) error {
+	if s.timeout > 0 {
+		// Not every writer supports deadlines, the write itself still reports errors
+		_ = s.rc.SetWriteDeadline(time.Now().Add(s.timeout))
+	}
+	for _, frame := range frames {
+		if _, err := s.w.Write([]byte(frame)); err != nil {
+			return err
+		}
+	}
+	return s.rc.Flush()
+}
@@ -2,36 +2,41 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 type Position struct {
-	Row int
-	Col int
+	Row int `json:"row"`
+	Col int `json:"col"`
 }
 
 type Cell struct {
-	IsPortal bool
-	Dest     Position
-	Value    int
-	Color    string
-	Players  []Player
+	IsPortal bool     `json:"is_portal"`
+	Dest     Position `json:"dest"`
+	Value    int      `json:"value"`
+	Color    string   `json:"color"`
+	// Filled in snapshots from the occupancy index, always empty on the live board
+	Players []Player `json:"players,omitempty"`
 }
 
 type TimerState struct {
-	StartedAt time.Time
-	EndedAt   time.Time
-	Active    bool
-	Elasped   time.Duration
+	StartedAt time.Time     `json:"started_at"`
+	EndedAt   time.Time     `json:"ended_at"`
+	Active    bool          `json:"active"`
+	Elasped   time.Duration `json:"elapsed"`
 }
 
 func (t *TimerState) StartNow() {
-	t.StartedAt = time.Now().UTC()
+	t.StartAt(time.Now().UTC())
+}
+
+func (t *TimerState) StartAt(at time.Time) {
+	t.StartedAt = at
 	t.EndedAt = time.Time{}
 	t.Active = true
 }
@@ -46,11 +51,15 @@ func (t *TimerState) StopNow() {
 }
 
 type Player struct {
-	ID       string   `json:"id"`
-	Name     string   `json:"name"`
-	Position Position `json:"postion"`
-	Rank     int      `json:"rank"`
-	Timer    TimerState
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Position Position   `json:"position"`
+	Rank     int        `json:"rank"`
+	Timer    TimerState `json:"timer"`
+	// Dice rolls made in the current round
+	Rolls int `json:"rolls"`
+	// Last roll of the round, shown on the player's dice until the next one
+	LastRoll int `json:"last_roll"`
 }
 
 type Event struct {
@@ -58,10 +67,16 @@ type Event struct {
 }
 
 type BestFinish struct {
-	PlayerName string
-	Elasped    time.Duration
+	PlayerName string        `json:"player_name"`
+	Elasped    time.Duration `json:"elapsed"`
+	GameID     string        `json:"game_id"`
+	BoardID    string        `json:"board_id,omitempty"`
+	Rolls      int           `json:"rolls"`
+	FinishedAt time.Time     `json:"finished_at"`
 }
 type Game struct {
+	ID              string
+	BoardID         string // New for every regenerated board, the game ID for the first one
 	Players         map[string]Player
 	Board           [][]Cell
 	Size            int
@@ -70,27 +85,102 @@ type Game struct {
 	LastCellVal     int
 	BestFinishes    []BestFinish
 	MaxBestFinishes int
+	// Cell -> IDs of the players on it, in arrival order
+	// Derived from Player.Position and the only record of who is where
+	Occupancy map[Position][]string
+	// Set by an admin, nil while the configured rules apply
+	Rules *Rules
 }
 
-// Initializes the Game board and Players
-func (game *Game) InitGame() {
-	// Collecting Game Features
-	maxPlayers, err := strconv.Atoi(os.Getenv("MAX_PLAYERS"))
-	if err != nil {
-		log.Fatalf("error while parsing MAX_PLAYERS env | error: %v\n", err)
+// Read-only copy of the Game taken under the lock
+// Templates and API responses render from snapshots, never from the live Game
+type GameSnapshot struct {
+	ID              string
+	BoardID         string
+	Players         map[string]Player
+	Board           [][]Cell
+	Size            int
+	LastCellVal     int
+	BestFinishes    []BestFinish
+	MaxBestFinishes int
+}
+
+// Returns a deep copy of the current game state
+func (game *Game) Snapshot() *GameSnapshot {
+	game.Mu.Lock()
+	defer game.Mu.Unlock()
+
+	players := make(map[string]Player, len(game.Players))
+	for id, p := range game.Players {
+		players[id] = p
 	}
-	boardDim, err := strconv.Atoi(os.Getenv("BOARD_DIM"))
-	if err != nil {
-		log.Fatalf("error while parsing BOARD_DIM env | error: %v\n", err)
+
+	board := copyBoard(game.Board)
+
+	// Occupants carry the current player data, not a copy from move time
+	for pos, ids := range game.Occupancy {
+		cell := &board[pos.Row][pos.Col]
+		cell.Players = make([]Player, 0, len(ids))
+		for _, id := range ids {
+			cell.Players = append(cell.Players, players[id])
+		}
 	}
-	maxPortals, err := strconv.Atoi(os.Getenv("MAX_PORTALS"))
-	if err != nil {
-		log.Fatalf("error while parsing MAX_PORTALS env | error: %v\n", err)
+
+	return &GameSnapshot{
+		ID:              game.ID,
+		BoardID:         game.BoardID,
+		Players:         players,
+		Board:           board,
+		Size:            game.Size,
+		LastCellVal:     game.LastCellVal,
+		BestFinishes:    append([]BestFinish(nil), game.BestFinishes...),
+		MaxBestFinishes: game.MaxBestFinishes,
 	}
-	maxBestFinishes, err := strconv.Atoi(os.Getenv("MAX_BEST_FINISHES"))
-	if err != nil {
-		log.Fatalf("error while parsing MAX_PORTALS env | error: %v\n", err)
+}
+
+// Players in the game, and those of them still racing this round
+func (game *Game) PlayerCounts() (joined, active int) {
+	game.Mu.Lock()
+	defer game.Mu.Unlock()
+
+	for _, player := range game.Players {
+		if player.Timer.Active {
+			active++
+		}
+	}
+	return len(game.Players), active
+}
+
+func copyBoard(board [][]Cell) [][]Cell {
+	out := make([][]Cell, len(board))
+	for r, row := range board {
+		out[r] = make([]Cell, len(row))
+		copy(out[r], row)
+	}
+	return out
+}
+
+// Builds the GameCreated event describing the current board
+func (game *Game) Created() GameCreated {
+	game.Mu.Lock()
+	defer game.Mu.Unlock()
+
+	return GameCreated{
+		EventMeta:       newMeta(),
+		GameID:          game.ID,
+		Size:            game.Size,
+		Board:           copyBoard(game.Board),
+		MaxBestFinishes: game.MaxBestFinishes,
 	}
+}
+
+// Initializes the Game board and Players
+func (game *Game) InitGame(cfg *Config) {
+	// Collecting Game Features
+	maxPlayers := cfg.MaxPlayers
+	boardDim := cfg.BoardDim
+	maxPortals := cfg.MaxPortals
+	maxBestFinishes := cfg.MaxBestFinishes
 
 	// Creating the Grid
 	grid := make([][]Cell, boardDim)
@@ -103,7 +193,7 @@ func (game *Game) InitGame() {
 
 	// Assigning Values to the Cells
 	dir := 1
-	defaultCellColor := os.Getenv("DEFAULT_CELL_COLOR")
+	defaultCellColor := cfg.DefaultCellColor
 	cellVal := game.LastCellVal
 	finder := make(map[int]Position)
 	for row := range boardDim {
@@ -182,9 +272,12 @@ func (game *Game) InitGame() {
 		grid[destRow][destCol].Color = color
 	}
 
+	game.ID = strconv.FormatInt(time.Now().UnixNano(), 36)
+	game.BoardID = game.ID
 	game.Board = grid
 	game.Size = boardDim
 	game.Players = make(map[string]Player, maxPlayers)
+	game.Occupancy = make(map[Position][]string)
 	game.Finder = finder
 	game.MaxBestFinishes = maxBestFinishes
 }
@@ -200,6 +293,13 @@ func (game *Game) AddPlayer(playerID, playerName string) error {
 		return fmt.Errorf("Player already exists")
 	}
 
+	// Names must be unique within the game
+	for _, p := range game.Players {
+		if strings.EqualFold(p.Name, playerName) {
+			return fmt.Errorf("Name is already taken")
+		}
+	}
+
 	startRow, startCol := game.Size-1, 0
 
 	player := Player{
@@ -216,29 +316,128 @@ func (game *Game) AddPlayer(playerID, playerName string) error {
 	game.Players[playerID] = player
 
 	// Adding player to the cell
-	game.Board[startRow][startCol].Players = append(game.Board[startRow][startCol].Players, player)
+	game.addPlayerToCell(playerID, player.Position)
 
 	return nil
 }
 
+// Returns the name of the player with the given player ID
+func (game *Game) PlayerName(playerID string) (string, error) {
+	game.Mu.Lock()
+	defer game.Mu.Unlock()
+
+	player, exists := game.Players[playerID]
+	if !exists {
+		return "", fmt.Errorf("Player doesn't exists")
+	}
+	return player.Name, nil
+}
+
+// Returns the player with the given player ID and the value of the cell they are on
+func (game *Game) PlayerCell(playerID string) (Player, int, error) {
+	game.Mu.Lock()
+	defer game.Mu.Unlock()
+
+	player, exists := game.Players[playerID]
+	if !exists {
+		return Player{}, -1, fmt.Errorf("Player doesn't exists")
+	}
+	return player, game.Board[player.Position.Row][player.Position.Col].Value, nil
+}
+
+// Puts every player back on the starting cell and restarts their timers at the given time
+func (game *Game) RestartRound(at time.Time) {
+	game.Mu.Lock()
+	defer game.Mu.Unlock()
+
+	game.placeAllAtStart(at)
+}
+
+// Swaps in the board of a freshly initialized game and restarts the round
+// Players and best finishes are kept
+func (game *Game) ReplaceBoard(fresh *Game, at time.Time) {
+	game.Mu.Lock()
+	defer game.Mu.Unlock()
+
+	game.BoardID = fresh.BoardID
+	game.Board = fresh.Board
+	game.Size = fresh.Size
+	game.Finder = fresh.Finder
+	game.LastCellVal = fresh.LastCellVal
+	game.placeAllAtStart(at)
+}
+
+func (game *Game) placeAllAtStart(at time.Time) {
+	game.Occupancy = make(map[Position][]string)
+
+	startRow, startCol := game.Size-1, 0
+	for id, player := range game.Players {
+		player.Position = Position{Row: startRow, Col: startCol}
+		player.Timer = TimerState{}
+		player.Timer.StartAt(at)
+		player.Rolls = 0
+		player.LastRoll = 0
+		game.Players[id] = player
+		game.addPlayerToCell(id, player.Position)
+	}
+}
+
+// Add player to the occupancy of the cell
+func (game *Game) addPlayerToCell(playerID string, pos Position) {
+	game.Occupancy[pos] = append(game.Occupancy[pos], playerID)
+}
+
 // Remove player from the cell
 func (game *Game) removePlayerFromCell(playerID string) {
-	idx := -1
 	pos := game.Players[playerID].Position
-	row, col := pos.Row, pos.Col
+	ids := game.Occupancy[pos]
 
-	for i, player := range game.Board[row][col].Players {
-		if player.ID == playerID {
-			idx = i
+	for i, id := range ids {
+		if id == playerID {
+			ids = append(ids[:i], ids[i+1:]...)
 			break
 		}
 	}
 
-	if idx != -1 {
-		game.Board[row][col].Players = append(game.Board[row][col].Players[:idx], game.Board[row][col].Players[idx+1:]...)
+	if len(ids) == 0 {
+		delete(game.Occupancy, pos)
+	} else {
+		game.Occupancy[pos] = ids
 	}
 }
 
+// Verifies that every player appears on exactly one cell, the one matching
+// their position, and that no cell lists an unknown player
+func (game *Game) CheckOccupancy() error {
+	game.Mu.Lock()
+	defer game.Mu.Unlock()
+
+	seen := make(map[string]Position, len(game.Players))
+	for pos, ids := range game.Occupancy {
+		for _, id := range ids {
+			if prev, dup := seen[id]; dup {
+				return fmt.Errorf("player %v is on cells %v and %v", id, prev, pos)
+			}
+			seen[id] = pos
+
+			player, exists := game.Players[id]
+			if !exists {
+				return fmt.Errorf("cell %v lists unknown player %v", pos, id)
+			}
+			if player.Position != pos {
+				return fmt.Errorf("player %v is at %v but listed on %v", id, player.Position, pos)
+			}
+		}
+	}
+
+	for id := range game.Players {
+		if _, ok := seen[id]; !ok {
+			return fmt.Errorf("player %v is on no cell", id)
+		}
+	}
+	return nil
+}
+
 // Remove the player with the given player ID from the Game
 func (game *Game) RemovePlayer(playerID string) (string, error) {
 	game.Mu.Lock()
@@ -264,17 +463,12 @@ func (game *Game) RemovePlayer(playerID string) (string, error) {
 }
 
 // Update best finishes
-func (game *Game) updateBestFinishes(playerName string, elasped time.Duration) {
-	log.Printf("%v\n", game.BestFinishes)
-	game.BestFinishes = append(game.BestFinishes, BestFinish{
-		PlayerName: playerName,
-		Elasped:    elasped,
-	})
+func (game *Game) updateBestFinishes(finish BestFinish) {
+	game.BestFinishes = append(game.BestFinishes, finish)
 	sort.Slice(game.BestFinishes, func(i, j int) bool {
 		return game.BestFinishes[i].Elasped < game.BestFinishes[j].Elasped
 	})
 
-	log.Printf("after sorting %v\n", game.BestFinishes)
 	if max := game.MaxBestFinishes; max > 0 && len(game.BestFinishes) > max {
 		game.BestFinishes = game.BestFinishes[:max]
 	}
@@ -293,6 +487,11 @@ func (game *Game) MovePlayer(steps int, playerID string) (Player, bool, bool, bo
 		return Player{}, false, false, false, -1, fmt.Errorf("Player doesn't exists")
 	}
 
+	// Every roll counts, even one that overshoots the last cell
+	playerState.Rolls++
+	playerState.LastRoll = steps
+	game.Players[playerID] = playerState
+
 	row, col := playerState.Position.Row, playerState.Position.Col
 
 	newVal := game.Board[row][col].Value + steps
@@ -300,7 +499,8 @@ func (game *Game) MovePlayer(steps int, playerID string) (Player, bool, bool, bo
 		return playerState, false, false, false, game.Board[row][col].Value, nil
 	}
 
-	log.Printf("old: %v | roll: %v | new: %v | newValPos: %v\n", game.Board[row][col].Value, steps, newVal, game.Finder[newVal])
+	slog.Debug("moving player", "game_id", game.ID, "action", "roll", "player_id", playerID,
+		"from", game.Board[row][col].Value, "roll", steps, "to", newVal, "to_pos", game.Finder[newVal])
 
 	// removing player from the game board
 	game.removePlayerFromCell(playerID)
@@ -322,12 +522,18 @@ func (game *Game) MovePlayer(steps int, playerID string) (Player, bool, bool, bo
 	// Checking if player has completed the game
 	hasCompleted := false
 	if game.Board[row][col].Value == game.LastCellVal && playerState.Timer.Active {
-		log.Print("stoping player\n")
 		playerState.Timer.StopNow()
-		log.Print("stopped player\n")
 		hasCompleted = true
-		game.updateBestFinishes(playerState.Name, playerState.Timer.Elasped)
-		log.Printf("best finishes: %v\n", game.BestFinishes)
+		game.updateBestFinishes(BestFinish{
+			PlayerName: playerState.Name,
+			Elasped:    playerState.Timer.Elasped,
+			GameID:     game.ID,
+			BoardID:    game.BoardID,
+			Rolls:      playerState.Rolls,
+			FinishedAt: playerState.Timer.EndedAt,
+		})
+		slog.Debug("player finished", "game_id", game.ID, "action", "roll", "player_id", playerID,
+			"elapsed", playerState.Timer.Elasped, "best_finishes", game.BestFinishes)
 	}
 
 	playerState.Position = Position{
@@ -336,10 +542,7 @@ func (game *Game) MovePlayer(steps int, playerID string) (Player, bool, bool, bo
 	}
 
 	game.Players[playerID] = playerState
-	game.Board[row][col].Players = append(
-		game.Board[row][col].Players,
-		game.Players[playerID],
-	)
+	game.addPlayerToCell(playerID, playerState.Position)
 
 	return playerState, teleported, true, hasCompleted, game.Board[row][col].Value, nil
 }
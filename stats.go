@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* Player statistics: folded from domain events, rebuilt from the event log at startup */
+
+type PlayerStats struct {
+	PlayerID    string        `json:"player_id"`
+	Name        string        `json:"name"`
+	GamesPlayed int           `json:"games_played"` // Rounds entered, by joining or when a new round starts
+	Finishes    int           `json:"finishes"`
+	BestTime    time.Duration `json:"best_time"`
+	AverageTime time.Duration `json:"average_time"`
+	TotalTime   time.Duration `json:"total_time"`
+	Rolls       int           `json:"rolls"`
+	// Roll value -> how many times it came up
+	RollCounts    map[int]int `json:"roll_counts"`
+	TeleportsUp   int         `json:"teleports_up"`
+	TeleportsDown int         `json:"teleports_down"`
+	// Cells gained by the best ladder and lost by the worst snake
+	LongestClimb int `json:"longest_climb"`
+	LongestFall  int `json:"longest_fall"`
+}
+
+// Average dice roll, the luck indicator
+func (s PlayerStats) AverageRoll() float64 {
+	if s.Rolls == 0 {
+		return 0
+	}
+	sum := 0
+	for roll, n := range s.RollCounts {
+		sum += roll * n
+	}
+	return float64(sum) / float64(s.Rolls)
+}
+
+type RollShare struct {
+	Roll    int
+	Count   int
+	Percent int
+}
+
+// Roll distribution ordered by roll value
+func (s PlayerStats) Distribution() []RollShare {
+	shares := []RollShare{}
+	for roll, n := range s.RollCounts {
+		shares = append(shares, RollShare{Roll: roll, Count: n, Percent: n * 100 / max(s.Rolls, 1)})
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].Roll < shares[j].Roll
+	})
+	return shares
+}
+
+type StatsBook struct {
+	mu      sync.Mutex
+	players map[string]*PlayerStats
+	// Game ID -> IDs of the players in it, who enter every new round
+	seated map[string]map[string]bool
+}
+
+// Builds the book from every game in the event log
+func NewStatsBook(eventLog *EventLog) *StatsBook {
+	book := &StatsBook{players: make(map[string]*PlayerStats), seated: make(map[string]map[string]bool)}
+
+	entries, err := ReadEventLog(eventLog.Path())
+	if err != nil && !os.IsNotExist(err) {
+		fatal("error while reading the event log for stats", "err", err)
+	}
+	for _, entry := range entries {
+		ev, err := entry.Event()
+		if err != nil {
+			slog.Warn("skipping event for stats", "game_id", entry.GameID, "seq", entry.Seq, "err", err)
+			continue
+		}
+		book.Observe(entry.GameID, ev)
+	}
+
+	return book
+}
+
+// Folds the events of the given game into the players' stats
+func (b *StatsBook) Observe(gameID string, events ...DomainEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, ev := range events {
+		switch ev := ev.(type) {
+		case PlayerJoined:
+			b.player(ev.PlayerID, ev.Name).GamesPlayed++
+			if b.seated[gameID] == nil {
+				b.seated[gameID] = make(map[string]bool)
+			}
+			b.seated[gameID][ev.PlayerID] = true
+		case PlayerLeft:
+			delete(b.seated[gameID], ev.PlayerID)
+		case GameStarted, BoardReset:
+			for id := range b.seated[gameID] {
+				if s, ok := b.players[id]; ok {
+					s.GamesPlayed++
+				}
+			}
+		case DiceRolled:
+			s := b.player(ev.PlayerID, ev.Name)
+			s.Rolls++
+			s.RollCounts[ev.Roll]++
+		case Teleported:
+			s := b.player(ev.PlayerID, ev.Name)
+			if climb := ev.To - ev.From; climb > 0 {
+				s.TeleportsUp++
+				s.LongestClimb = max(s.LongestClimb, climb)
+			} else {
+				s.TeleportsDown++
+				s.LongestFall = max(s.LongestFall, -climb)
+			}
+		case Completed:
+			s := b.player(ev.PlayerID, ev.Name)
+			s.Finishes++
+			s.TotalTime += ev.Elapsed
+			s.AverageTime = s.TotalTime / time.Duration(s.Finishes)
+			if s.BestTime == 0 || ev.Elapsed < s.BestTime {
+				s.BestTime = ev.Elapsed
+			}
+		}
+	}
+}
+
+// Stats entry of the player, created on first sight; the latest name wins
+func (b *StatsBook) player(playerID, name string) *PlayerStats {
+	s, ok := b.players[playerID]
+	if !ok {
+		s = &PlayerStats{
+			PlayerID:   playerID,
+			RollCounts: make(map[int]int),
+		}
+		b.players[playerID] = s
+	}
+	s.Name = name
+	return s
+}
+
+// Returns a copy of the player's stats
+func (b *StatsBook) Get(playerID string) (PlayerStats, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.players[playerID]
+	if !ok {
+		return PlayerStats{}, false
+	}
+	stats := *s
+	stats.RollCounts = make(map[int]int, len(s.RollCounts))
+	for roll, n := range s.RollCounts {
+		stats.RollCounts[roll] = n
+	}
+	return stats, true
+}
+
+// Stats of the given players, keyed by player ID
+func (b *StatsBook) For(playerIDs []string) map[string]PlayerStats {
+	out := make(map[string]PlayerStats, len(playerIDs))
+	for _, id := range playerIDs {
+		if s, ok := b.Get(id); ok {
+			out[id] = s
+		}
+	}
+	return out
+}
+
+// Stats of the players in the snapshot, for the players panel
+func (h *GameHandler) playersStats(snap *GameSnapshot) map[string]PlayerStats {
+	ids := make([]string, 0, len(snap.Players))
+	for id := range snap.Players {
+		ids = append(ids, id)
+	}
+	return h.Stats.For(ids)
+}
+
+func (h *GameHandler) PlayerStatsPage(c *gin.Context) {
+	stats, ok := h.Stats.Get(c.Param("id"))
+	if !ok {
+		c.String(http.StatusNotFound, "Player not found")
+		return
+	}
+	c.HTML(http.StatusOK, "player_stats.html", gin.H{"Stats": stats})
+}
+
+func (h *GameHandler) APIPlayerStats(c *gin.Context) {
+	stats, ok := h.Stats.Get(c.Param("id"))
+	if !ok {
+		apiError(c, http.StatusNotFound, fmt.Errorf("Player doesn't exists"))
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
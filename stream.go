@@ -1,9 +1,6 @@
 package main
 
 import (
-	"log"
-	"os"
-	"strconv"
 	"sync"
 	"time"
 )
@@ -14,12 +11,16 @@ const (
 	MOVE       string = "MOVE"
 	TELEPORTED string = "TELEPORTED"
 	COMPLETED  string = "COMPLETED"
+	CHAT       string = "CHAT"
+	SYSTEM     string = "SYSTEM"
+	// Audit trail of admin actions
+	ADMIN string = "ADMIN"
 )
 
 type StreamLog struct {
-	TimeStamp time.Time
-	Message   string
-	LogType   string
+	TimeStamp time.Time `json:"timestamp"`
+	Message   string    `json:"message"`
+	LogType   string    `json:"type"`
 }
 
 /* Ring Buffer: Max Heap by Timestamp */
@@ -89,11 +90,7 @@ type Stream struct {
 	mu   sync.Mutex
 }
 
-func NewStreamer() *Stream {
-	maxStreams, err := strconv.Atoi(os.Getenv("MAX_STREAMS"))
-	if err != nil {
-		log.Fatalf("error while parsing MAX_STREAMS | error: %v\n", err)
-	}
+func NewStreamer(maxStreams int) *Stream {
 	s := &Stream{
 		Logs: NewRingBuffer(maxStreams),
 	}
@@ -107,6 +104,16 @@ func (s *Stream) Push(log StreamLog) {
 	s.Logs.Add(log)
 }
 
+// Refills the stream from logs ordered newest first, as GetLogs returns them
+func (s *Stream) Restore(logs []StreamLog) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(logs) - 1; i >= 0; i-- {
+		s.Logs.Add(logs[i])
+	}
+}
+
 func (s *Stream) GetLogs() []StreamLog {
 	s.mu.Lock()
 	defer s.mu.Unlock()
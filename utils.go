@@ -36,7 +36,7 @@ func GenerateVibrantRandomColor() string {
 	return fmt.Sprintf("#%02X%02X%02X", r, g, b)
 }
 
-func GetCurrentPlayers(game *Game) []Player {
+func GetCurrentPlayers(game *GameSnapshot) []Player {
 	players := make([]Player, 0)
 	for _, p := range game.Players {
 		players = append(players, p)
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+/* WebSocket transport: same Broker events as SSE, plus client commands */
+
+const (
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = (wsPongWait * 9) / 10
+	wsMaxMessageSize = 4096
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// Frame sent from the server to the client
+// Type is "event" for Broker events, "result" for command replies and "error"
+type WSOutgoing struct {
+	Type    string `json:"type"`
+	ID      uint64 `json:"id,omitempty"`
+	Event   string `json:"event,omitempty"`
+	HTML    string `json:"html,omitempty"`
+	Command string `json:"command,omitempty"`
+	Data    any    `json:"data,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Command sent from the client to the server
+// Type is one of "roll", "join", "leave" or "chat"
+type WSIncoming struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+	Text string `json:"text,omitempty"`
+}
+
+func (h *GameHandler) WebSocket(c *gin.Context) {
+	playerID, ok := h.apiPlayerID(c)
+	if !ok {
+		c.String(http.StatusBadRequest, "Player id required")
+		return
+	}
+
+	topics, err := ParseTopics(c.Query("topics"))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		h.actionLogger(c, "ws", playerID).Warn("error while upgrading websocket", "err", err)
+		return
+	}
+
+	// Commands log with the request ID of the upgrade, without touching its access log line
+	ctx := context.WithValue(context.Background(), loggerKey, loggerFrom(c))
+
+	ch := make(chan Message, 8)
+	h.Broker.Add(ch, playerID, topics)
+
+	// Replies to commands are written by the writer goroutine only
+	replies := make(chan WSOutgoing, 8)
+	done := make(chan struct{})
+
+	go h.wsWritePump(conn, ch, replies, done, playerID, topics)
+	h.wsReadPump(ctx, conn, replies, playerID)
+
+	// Reader has exited: unregister and stop the writer
+	close(done)
+	h.Broker.Remove(ch)
+}
+
+// Reads commands until the socket closes or a pong is missed
+func (h *GameHandler) wsReadPump(ctx context.Context, conn *websocket.Conn, replies chan<- WSOutgoing, playerID string) {
+	logger := gameLogger(loggerFrom(ctx), h.Game.ID, "ws", playerID)
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var cmd WSIncoming
+		if err := conn.ReadJSON(&cmd); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logger.Warn("error while reading websocket", "err", err)
+			}
+			return
+		}
+
+		reply := h.wsHandleCommand(ctx, cmd, playerID)
+		select {
+		case replies <- reply:
+		default:
+			logger.Warn("dropping websocket reply, writer is behind", "command", cmd.Type)
+		}
+	}
+}
+
+// Writes Broker events, command replies and pings to the socket
+func (h *GameHandler) wsWritePump(conn *websocket.Conn, ch chan Message, replies <-chan WSOutgoing, done <-chan struct{}, playerID string, topics []string) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+	}()
+
+	write := func(frame WSOutgoing) bool {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteJSON(frame) == nil
+	}
+
+	// Sending initial events
+	for _, msg := range h.initialEvents(playerID, topics) {
+		if !write(WSOutgoing{Type: "event", ID: msg.ID, Event: msg.Event, HTML: msg.Data}) {
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-done:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		case <-h.quit:
+			// Shutting down: 1012 tells the client to reconnect later
+			write(WSOutgoing{Type: "event", Event: "restarting", HTML: h.Render("_restarting.html", nil)})
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, "Server is restarting"))
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			for _, msg := range msg.Events() {
+				if !write(WSOutgoing{Type: "event", ID: msg.ID, Event: msg.Event, HTML: msg.Data}) {
+					return
+				}
+			}
+
+			// Catching up with a full render once the backlog has drained
+			if _, ok := h.Broker.TakeResync(ch); ok {
+				for _, msg := range h.initialEvents(playerID, topics) {
+					if !write(WSOutgoing{Type: "event", Event: msg.Event, HTML: msg.Data}) {
+						return
+					}
+				}
+			}
+		case reply := <-replies:
+			if !write(reply) {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (h *GameHandler) wsHandleCommand(ctx context.Context, cmd WSIncoming, playerID string) WSOutgoing {
+	var (
+		data any
+		err  error
+	)
+
+	switch cmd.Type {
+	case "roll":
+		data, err = h.roll(ctx, playerID)
+	case "join":
+		var name string
+		name, err = h.join(ctx, playerID, cmd.Name)
+		data = apiJoinResponse{PlayerID: playerID, Name: name}
+	case "leave":
+		var name string
+		name, err = h.leave(ctx, playerID)
+		data = apiLeaveResponse{PlayerID: playerID, Name: name}
+	case "chat":
+		err = h.chat(ctx, playerID, cmd.Text)
+	default:
+		err = fmt.Errorf("Unknown command %q", cmd.Type)
+	}
+
+	if err != nil {
+		return WSOutgoing{Type: "error", Command: cmd.Type, Error: err.Error()}
+	}
+	return WSOutgoing{Type: "result", Command: cmd.Type, Data: data}
+}